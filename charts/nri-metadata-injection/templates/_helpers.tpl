@@ -48,6 +48,10 @@ Naming helpers
 {{ include "newrelic.common.naming.truncateToDNSWithSuffix" (dict "name" (include "newrelic.common.naming.fullname" .) "suffix" "admission-patch") }}
 {{- end -}}
 
+{{- define "nri-metadata-injection.fullname.self-signed" -}}
+{{ include "newrelic.common.naming.truncateToDNSWithSuffix" (dict "name" (include "newrelic.common.naming.fullname" .) "suffix" "self-signed") }}
+{{- end -}}
+
 {{- define "nri-metadata-injection.name.self-signed-issuer" -}}
 {{ include "newrelic.common.naming.truncateToDNSWithSuffix" (dict "name" (include "newrelic.common.naming.name" .) "suffix" "self-signed-issuer") }}
 {{- end -}}
@@ -71,3 +75,37 @@ Naming helpers
 {{- define "nri-metadata-injection.fullname.webhook-cert" -}}
 {{ include "newrelic.common.naming.truncateToDNSWithSuffix" (dict "name" (include "newrelic.common.naming.fullname" .) "suffix" "webhook-cert") }}
 {{- end -}}
+
+{{- /*
+Rules of the ClusterRole of the webhook, granting the API access of the enabled features.
+*/ -}}
+{{- define "nri-metadata-injection.clusterRole.rules" -}}
+{{- /* The namespace selector of the injection config can be set by a reload, so the namespaces are always readable. */ -}}
+- apiGroups: [""]
+  resources: ["namespaces"]
+  verbs: ["get"]
+{{- if .Values.ownerLookup }}
+- apiGroups: ["apps"]
+  resources: ["replicasets"]
+  verbs: ["get"]
+- apiGroups: ["batch"]
+  resources: ["jobs"]
+  verbs: ["get"]
+{{- end }}
+{{- if .Values.selfSignedCertificates.enabled }}
+- apiGroups: ["admissionregistration.k8s.io"]
+  resources: ["mutatingwebhookconfigurations"]
+  resourceNames: [{{ include "newrelic.common.naming.fullname" . | quote }}]
+  verbs: ["get", "update"]
+{{- end }}
+{{- if .Values.envFrom.resolve }}
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["get"]
+{{- if .Values.envFrom.resolveSecrets }}
+- apiGroups: [""]
+  resources: ["secrets"]
+  verbs: ["get"]
+{{- end }}
+{{- end }}
+{{- end -}}
@@ -3,28 +3,42 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	"github.com/newrelic/k8s-metadata-injection/src/server"
 )
 
 const (
 	appName = "new-relic-k8s-metadata-injection"
+
+	certExpiryCheckInterval = 10 * time.Minute
+
+	selfSignedCheckInterval = 10 * time.Minute
+	selfSignedRetryInterval = 10 * time.Second
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
+var errSelfSignedMissingNames = errors.New("NEW_RELIC_K8S_METADATA_INJECTION_WEBHOOK_CONFIG_NAME and NEW_RELIC_K8S_METADATA_INJECTION_SERVICE_NAME are required")
+
 // specification contains the specs for this app.
 type specification struct {
 	Port        int           `default:"8443"`                                                     // Webhook server port.
@@ -34,6 +48,62 @@ type specification struct {
 	ClusterName string        `default:"cluster" split_words:"true"`                               // The name of the Kubernetes cluster.
 	Timeout     time.Duration `default:"1s"`                                                       // Server timeout for the pod mutation.
 	LogLevel    string        `default:"info" split_words:"true"`                                  // Log level (debug, info, warn, error, dpanic, panic, fatal).
+
+	CertExpiryWarnings []time.Duration `default:"720h,168h,24h" split_words:"true"` // Remaining validity of the certificate at which a warning is logged.
+	CertDNSNames       []string        `envconfig:"cert_dns_names"`                 // DNS names the loaded certificates must be valid for.
+	CertPollInterval   time.Duration   `default:"1m" split_words:"true"`            // How often the certificate files are checked for changes missed by the watcher.
+
+	TLSMinVersion   string   `envconfig:"tls_min_version"`   // Minimum TLS version (1.0, 1.1, 1.2, 1.3). Go default when empty.
+	TLSMaxVersion   string   `envconfig:"tls_max_version"`   // Maximum TLS version (1.0, 1.1, 1.2, 1.3). Go default when empty.
+	TLSCipherSuites []string `envconfig:"tls_cipher_suites"` // TLS 1.0-1.2 cipher suites, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go default when empty.
+	TLSCurves       []string `envconfig:"tls_curves"`        // Key exchange curves by order of preference, like X25519 or P-256. Go default when empty.
+
+	ClientCAFile       string   `envconfig:"client_ca_file"` // CA bundle the client certificates must be signed by. Clients are not verified when empty.
+	AllowedClientNames []string `split_words:"true"`         // Subject common names or SANs allowed for the clients (globs, or regexps enclosed in slashes).
+
+	SelfSignedCerts        bool          `default:"false" split_words:"true"`                              // Generate the CA and serving certificate instead of loading TLSCERTFILE and TLSKEYFILE.
+	SelfSignedSecret       string        `default:"nri-metadata-injection-self-signed" split_words:"true"` // Secret storing the self-signed certificates.
+	SelfSignedCAValidity   time.Duration `default:"87600h" envconfig:"self_signed_ca_validity"`            // Validity of the self-signed CA.
+	SelfSignedCertValidity time.Duration `default:"8760h" split_words:"true"`                              // Validity of the self-signed serving certificate.
+	SelfSignedRenewBefore  time.Duration `default:"720h" split_words:"true"`                               // Remaining validity at which the self-signed certificates are renewed.
+	WebhookConfigName      string        `split_words:"true"`                                              // MutatingWebhookConfiguration whose caBundle is patched with the self-signed CA.
+	ServiceName            string        `split_words:"true"`                                              // Service of the webhook, the self-signed certificate is valid for its DNS names.
+	Namespace              string        // Namespace of the webhook. Defaults to the one of its service account.
+
+	InjectInitContainers      bool `default:"false" split_words:"true"` // Inject the metadata also in the init containers.
+	InjectEphemeralContainers bool `default:"false" split_words:"true"` // Inject the metadata in ephemeral containers (pods/ephemeralcontainers).
+
+	AdmissionWarnings bool `default:"false" split_words:"true"` // Warn the users about the variables already defined and the unsupported owners.
+
+	OwnerLookup   bool          `default:"false" split_words:"true"`       // Resolve the Deployment and CronJob of the pods through the Kubernetes API.
+	OwnerCacheTTL time.Duration `default:"5m" envconfig:"owner_cache_ttl"` // How long the owner lookups are cached.
+
+	NamespaceCacheTTL time.Duration `default:"1m" envconfig:"namespace_cache_ttl"` // How long the namespace labels are cached.
+
+	ResolveEnvFrom        bool          `default:"false" split_words:"true"`          // Apply the conflict policy to the variables defined through envFrom.
+	ResolveEnvFromSecrets bool          `default:"true" split_words:"true"`           // Also read the keys of the envFrom Secrets, not only of the ConfigMaps.
+	EnvFromCacheTTL       time.Duration `default:"1m" envconfig:"env_from_cache_ttl"` // How long the keys of the envFrom sources are cached.
+
+	InjectionConfigFile string        `split_words:"true"`              // YAML file declaring the variables to inject. Defaults are used when empty.
+	ConfigPollInterval  time.Duration `default:"1m" split_words:"true"` // How often the injection config file is checked for changes missed by the watcher.
+
+	IgnoredNamespaces      []string `default:"kube-system,kube-public" split_words:"true"` // Namespaces never mutated (globs, or regexps enclosed in slashes).
+	ExtraIgnoredNamespaces []string `split_words:"true"`                                   // Namespaces never mutated, in addition to IGNORED_NAMESPACES.
+	ConflictPolicy         string   `default:"skip" split_words:"true"`                    // How to handle variables already defined in the containers (skip, replace, fail).
+
+	ErrorPolicy map[string]string `split_words:"true"` // Whether the pods that can't be mutated are admitted by error class, like invalidObject:deny,internal:allow.
+
+	PodIdentity []string `split_words:"true"` // Opt-in pod identity fields (uid, podIP, podIPs, hostIP, serviceAccountName, priorityClassName, qosClass).
+
+	ContainerResources map[string]string `split_words:"true"` // Opt-in container resources by divisor, like limits.cpu:1m,limits.memory:1Mi.
+
+	InjectionMode     string `default:"env" split_words:"true"`                    // How the metadata is injected (env, volume, both).
+	MetadataMountPath string `default:"/etc/newrelic/metadata" split_words:"true"` // Directory where the metadata volume is mounted in the volume and both modes.
+
+	NamingProfiles []string `default:"newrelic" split_words:"true"` // Naming profiles of the injected variables (newrelic, generic, custom).
+	CustomPrefix   string   `split_words:"true"`                    // Prefix of the variables of the custom naming profile, like ACME_K8S_.
+
+	OpenTelemetry bool `default:"false" split_words:"true"` // Also inject OTEL_RESOURCE_ATTRIBUTES with the matching Kubernetes resource attributes.
 }
 
 func main() {
@@ -46,44 +116,167 @@ func main() {
 	logger := setupLogger(s.LogLevel)
 	defer func() { _ = logger.Sync() }()
 
-	pair, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
-	if err != nil {
-		logger.Errorw("failed to load key pair", "err", err)
+	// The settings of the specification are the defaults for the ones missing in the injection config file.
+	defaultConfig := server.DefaultInjectionConfig()
+	defaultConfig.IgnoredNamespaces = append(s.IgnoredNamespaces, s.ExtraIgnoredNamespaces...)
+	defaultConfig.ConflictPolicy = server.ConflictPolicy(s.ConflictPolicy)
+	for _, field := range s.PodIdentity {
+		defaultConfig.PodIdentity = append(defaultConfig.PodIdentity, server.PodIdentityField(field))
+	}
+	for name, divisor := range s.ContainerResources {
+		if defaultConfig.ContainerResources == nil {
+			defaultConfig.ContainerResources = make(map[string]resource.Quantity, len(s.ContainerResources))
+		}
+		// An empty divisor keeps the default one, 1.
+		var quantity resource.Quantity
+		if divisor != "" {
+			if quantity, err = resource.ParseQuantity(divisor); err != nil {
+				logger.Fatalw("invalid container resource divisor", "resource", name, "err", err)
+			}
+		}
+		defaultConfig.ContainerResources[name] = quantity
+	}
+	defaultConfig.Mode = server.InjectionMode(s.InjectionMode)
+	defaultConfig.Volume.MountPath = s.MetadataMountPath
+	defaultConfig.Naming.CustomPrefix = s.CustomPrefix
+	defaultConfig.Naming.Profiles = nil
+	for _, profile := range s.NamingProfiles {
+		defaultConfig.Naming.Profiles = append(defaultConfig.Naming.Profiles, server.NamingProfile(profile))
+	}
+	defaultConfig.OpenTelemetry = s.OpenTelemetry
+	for class, policy := range s.ErrorPolicy {
+		if defaultConfig.ErrorPolicy == nil {
+			defaultConfig.ErrorPolicy = make(map[server.ErrorClass]server.FailurePolicy, len(s.ErrorPolicy))
+		}
+		defaultConfig.ErrorPolicy[server.ErrorClass(class)] = server.FailurePolicy(policy)
+	}
+	if err := defaultConfig.Compile(); err != nil {
+		logger.Fatalw("invalid configuration", "err", err)
 	}
 
-	watcher, _ := fsnotify.NewWatcher()
-	defer func() { _ = watcher.Close() }()
-	// Watch the parent directory of the key/cert files so we can catch
-	// symlink updates of k8s secrets volumes and reload the certificates whenever they change.
-	watchDir, _ := filepath.Split(s.TLSCertFile)
-	if err := watcher.Add(watchDir); err != nil {
-		logger.Errorw("could not watch folder", "folder", watchDir, "err", err)
+	injectionConfig := defaultConfig
+	if s.InjectionConfigFile != "" {
+		injectionConfig, err = server.LoadInjectionConfig(s.InjectionConfigFile, defaultConfig)
+		if err != nil {
+			logger.Fatalw("failed to load injection config", "file", s.InjectionConfigFile, "err", err)
+		}
 	}
 
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := server.NewMetrics(registry)
+
 	whsvr := &server.Webhook{
-		KeyFile:     s.TLSKeyFile,
-		CertFile:    s.TLSCertFile,
-		Cert:        &pair,
 		ClusterName: s.ClusterName,
-		CertWatcher: watcher,
+		Config:      injectionConfig,
+		Metrics:     metrics,
+
+		CertDNSNames: s.CertDNSNames,
+
+		InjectInitContainers:      s.InjectInitContainers,
+		InjectEphemeralContainers: s.InjectEphemeralContainers,
+		AdmissionWarnings:         s.AdmissionWarnings,
 		Server: &http.Server{
 			Addr: fmt.Sprintf(":%d", s.Port),
 		},
 		Logger: logger,
 	}
+	// Self-signed certificates are not read from files, they are loaded once the webhook can reach the Kubernetes API.
+	if !s.SelfSignedCerts {
+		whsvr.CertFile, whsvr.KeyFile = s.TLSCertFile, s.TLSKeyFile
+		if err := whsvr.ReloadCert(); err != nil {
+			logger.Errorw("failed to load key pair", "err", err)
+		}
+	}
 	whsvr.Server.TLSConfig = &tls.Config{GetCertificate: whsvr.GetCert}
+	tlsOptions := server.TLSOptions{
+		MinVersion:   s.TLSMinVersion,
+		MaxVersion:   s.TLSMaxVersion,
+		CipherSuites: s.TLSCipherSuites,
+		Curves:       s.TLSCurves,
+	}
+	if err := tlsOptions.Apply(whsvr.Server.TLSConfig); err != nil {
+		logger.Fatalw("invalid TLS configuration", "err", err)
+	}
+
+	if s.ClientCAFile != "" {
+		whsvr.ClientAuth, err = server.NewClientAuth(s.ClientCAFile, s.AllowedClientNames)
+		if err != nil {
+			logger.Fatalw("invalid client authentication configuration", "err", err)
+		}
+		if err := whsvr.ClientAuth.Reload(); err != nil {
+			logger.Errorw("failed to load client CA bundle", "err", err)
+		}
+		whsvr.ClientAuth.Configure(whsvr.Server.TLSConfig)
+	}
+
+	certExpiry := &server.CertExpiryMonitor{Webhook: whsvr, Thresholds: s.CertExpiryWarnings}
+	certExpiry.Check(time.Now())
+	certExpiryTicker := time.NewTicker(certExpiryCheckInterval)
+	defer certExpiryTicker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The injection config is usually a mounted ConfigMap, whose updates are also symlink swaps in its parent directory.
+	if s.InjectionConfigFile != "" {
+		configReloader := server.NewFileReloader("injection config", []string{s.InjectionConfigFile}, s.ConfigPollInterval, func() {
+			config, err := server.LoadInjectionConfig(s.InjectionConfigFile, defaultConfig)
+			if err != nil {
+				logger.Errorw("reload injection config error, keeping the previous one", "err", err)
+				return
+			}
+			whsvr.SetConfig(config)
+			logger.Info("injection config reloaded!")
+		}, logger)
+		go configReloader.Run(ctx)
+	}
+	if whsvr.CertFile != "" || whsvr.ClientAuth != nil {
+		certReloader := server.NewCertReloader(whsvr, s.CertPollInterval)
+		certReloader.OnReload = func(error) { certExpiry.Check(time.Now()) }
+		go certReloader.Run(ctx)
+	}
+
+	client, err := newKubernetesClient()
+	if err != nil {
+		logger.Warnw("could not create kubernetes client, features relying on the API are disabled", "err", err)
+	} else {
+		whsvr.Namespaces = server.NewNamespaceResolver(client, s.NamespaceCacheTTL)
+		if s.OwnerLookup {
+			whsvr.Owners = server.NewOwnerResolver(client, s.OwnerCacheTTL)
+		}
+		if s.ResolveEnvFrom {
+			whsvr.EnvFrom = server.NewEnvFromResolver(client, s.EnvFromCacheTTL)
+			whsvr.EnvFrom.IgnoreSecrets = !s.ResolveEnvFromSecrets
+		}
+	}
+
+	var selfSigned *server.SelfSignedCertificates
+	var selfSignedTimer <-chan time.Time
+	if s.SelfSignedCerts {
+		if client == nil {
+			logger.Fatal("self-signed certificates require access to the kubernetes API")
+		}
+		selfSigned, err = newSelfSignedCertificates(s, client)
+		if err != nil {
+			logger.Fatalw("invalid self-signed certificates configuration", "err", err)
+		}
+		selfSignedTimer = time.After(0)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/mutate", withLoggingMiddleware(logger)(withTimeoutMiddleware(s.Timeout)(whsvr)))
+	mux.Handle("/mutate", withLoggingMiddleware(logger)(withTimeoutMiddleware(s.Timeout, metrics)(whsvr)))
 	whsvr.Server.Handler = mux
 
 	// The health check needs to be in another server because it cannot be under TLS.
-	readinessProbe := server.TLSReadyReadinessProbe(whsvr)
+	// The metrics are served along with it, any other path is the readiness probe.
+	healthMux := http.NewServeMux()
+	healthMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	healthMux.Handle("/", server.TLSReadyReadinessProbe(whsvr))
 	go func() {
 		logger.Info("starting the TLS readiness server")
 		healthServer := &http.Server{
 			Addr:         fmt.Sprintf(":%d", s.HealthPort),
-			Handler:      readinessProbe,
+			Handler:      healthMux,
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 5 * time.Second,
 			IdleTimeout:  60 * time.Second,
@@ -104,40 +297,105 @@ func main() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	var debounceTimer <-chan time.Time
 	for {
 		select {
-		case <-debounceTimer:
-			pair, err := tls.LoadX509KeyPair(whsvr.CertFile, whsvr.KeyFile)
+		case <-selfSignedTimer:
+			cert, generated, err := selfSigned.Ensure(ctx)
 			if err != nil {
-				logger.Errorw("reload cert error", "err", err)
+				metrics.ObserveCertReload(err)
+				logger.Errorw("could not ensure the self-signed certificates, retrying", "err", err)
+				selfSignedTimer = time.After(selfSignedRetryInterval)
 				break
 			}
-			whsvr.Lock()
-			whsvr.Cert = &pair
-			whsvr.Unlock()
-			logger.Info("cert/key pair reloaded!")
-		case event := <-whsvr.CertWatcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				debounceTimer = time.After(500 * time.Millisecond)
+			if generated {
+				logger.Info("self-signed certificates generated")
 			}
+			// The periodic checks only count as reloads when they change the certificate served.
+			if generated || !whsvr.ServesCert(cert) {
+				whsvr.SetCert(cert)
+				metrics.ObserveCertReload(nil)
+			}
+			certExpiry.Check(time.Now())
+			selfSignedTimer = time.After(selfSignedCheckInterval)
+		case now := <-certExpiryTicker.C:
+			certExpiry.Check(now)
 		case <-signalChan:
 			logger.Info("got OS shutdown signal, shutting down webhook server gracefully...")
-			_ = watcher.Close()
+			cancel()
 			_ = whsvr.Server.Shutdown(context.Background())
 			return
 		}
 	}
 }
 
-func withTimeoutMiddleware(timeout time.Duration) func(next http.Handler) http.Handler {
+// newKubernetesClient returns a client for the API server of the cluster the webhook runs in.
+func newKubernetesClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading in-cluster config: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating client: %w", err)
+	}
+	return client, nil
+}
+
+// newSelfSignedCertificates returns the generator of the self-signed certificates configured in the specification.
+func newSelfSignedCertificates(s specification, client kubernetes.Interface) (*server.SelfSignedCertificates, error) {
+	if s.WebhookConfigName == "" || s.ServiceName == "" {
+		return nil, errSelfSignedMissingNames
+	}
+	namespace := s.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading the namespace of the service account: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &server.SelfSignedCertificates{
+		Client:            client,
+		Namespace:         namespace,
+		SecretName:        s.SelfSignedSecret,
+		WebhookConfigName: s.WebhookConfigName,
+		DNSNames: []string{
+			s.ServiceName,
+			s.ServiceName + "." + namespace,
+			s.ServiceName + "." + namespace + ".svc",
+			s.ServiceName + "." + namespace + ".svc.cluster.local",
+		},
+		CAValidity:   s.SelfSignedCAValidity,
+		CertValidity: s.SelfSignedCertValidity,
+		RenewBefore:  s.SelfSignedRenewBefore,
+	}, nil
+}
+
+func withTimeoutMiddleware(timeout time.Duration, metrics *server.Metrics) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.TimeoutHandler(next, timeout, "server timeout").ServeHTTP(w, r)
+			recorder := &statusRecorder{ResponseWriter: w}
+			http.TimeoutHandler(next, timeout, "server timeout").ServeHTTP(recorder, r)
+			// The webhook never replies with 503 by itself, so it is the timeout handler giving up.
+			if recorder.status == http.StatusServiceUnavailable {
+				metrics.ObserveTimeout()
+			}
 		})
 	}
 }
 
+// statusRecorder is a ResponseWriter keeping the status code written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
 func withLoggingMiddleware(logger *zap.SugaredLogger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/newrelic/k8s-metadata-injection/src/server"
 )
 
 func TestSetupLogger_ValidLogLevels(test *testing.T) {
@@ -131,3 +139,33 @@ func TestSetupLogger_InvalidLogLevels(test *testing.T) {
 		})
 	}
 }
+
+func TestWithTimeoutMiddleware(test *testing.T) {
+	test.Parallel()
+	registry := prometheus.NewRegistry()
+	metrics := server.NewMetrics(registry)
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, handler := range []http.Handler{slow, fast} {
+		recorder := httptest.NewRecorder()
+		withTimeoutMiddleware(10*time.Millisecond, metrics)(handler).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate", nil))
+	}
+
+	expected := `
+# HELP nri_metadata_injection_timeouts_total Admission requests that exceeded the server timeout.
+# TYPE nri_metadata_injection_timeouts_total counter
+nri_metadata_injection_timeouts_total 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nri_metadata_injection_timeouts_total"); err != nil {
+		test.Error(err)
+	}
+}
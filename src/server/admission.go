@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// Keys of the audit annotations of the admission responses. The API server prefixes them with the webhook name.
+const (
+	auditAnnotationSkipReason           = "skip-reason"
+	auditAnnotationInjectedVariables    = "injected-variables"
+	auditAnnotationSkippedContainers    = "skipped-containers"
+	auditAnnotationConflictingVariables = "conflicting-variables"
+)
+
+// maxWarningLength is the length above which the API server truncates each warning of an admission response. The
+// warnings are kept under it so they are shown in full, the audit annotations holding the complete lists.
+const maxWarningLength = 120
+
+var (
+	errUnsupportedAdmissionReview = errors.New("unsupported admission API Version request")
+	errInvalidAdmissionReview     = errors.New("invalid admission review")
+	errInvalidObject              = errors.New("invalid object in admission request")
+)
+
+func init() {
+	// Only the registered versions of AdmissionReview can be decoded.
+	utilruntime.Must(admissionv1.AddToScheme(runtimeScheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(runtimeScheme))
+}
+
+// decodeAdmissionReview decodes an AdmissionReview of any supported version. The review is returned as a v1 one,
+// along with its original version the response must be sent in. The version is also returned along with the error
+// when the body is an AdmissionReview of an unsupported version or with invalid fields, so the error can be reported
+// in a response.
+func decodeAdmissionReview(body []byte) (*admissionv1.AdmissionReview, schema.GroupVersionKind, error) {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		if gvk == nil || gvk.Kind != "AdmissionReview" {
+			return nil, schema.GroupVersionKind{}, err
+		}
+		if !runtimeScheme.Recognizes(*gvk) {
+			return nil, *gvk, fmt.Errorf("%w: %q", errUnsupportedAdmissionReview, gvk.GroupVersion())
+		}
+		return nil, *gvk, fmt.Errorf("%w: %w", errInvalidAdmissionReview, err)
+	}
+
+	switch review := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		return review, *gvk, nil
+	case *admissionv1beta1.AdmissionReview:
+		// The types of both versions have the same fields, see
+		// https://kubernetes.io/docs/reference/access-authn-authz/extensible-admission-controllers/#webhook-request-and-response.
+		converted := &admissionv1.AdmissionReview{TypeMeta: review.TypeMeta}
+		if req := review.Request; req != nil {
+			converted.Request = &admissionv1.AdmissionRequest{
+				UID:                req.UID,
+				Kind:               req.Kind,
+				Resource:           req.Resource,
+				SubResource:        req.SubResource,
+				RequestKind:        req.RequestKind,
+				RequestResource:    req.RequestResource,
+				RequestSubResource: req.RequestSubResource,
+				Name:               req.Name,
+				Namespace:          req.Namespace,
+				Operation:          admissionv1.Operation(req.Operation),
+				UserInfo:           req.UserInfo,
+				Object:             req.Object,
+				OldObject:          req.OldObject,
+				DryRun:             req.DryRun,
+				Options:            req.Options,
+			}
+		}
+		return converted, *gvk, nil
+	default:
+		return nil, schema.GroupVersionKind{}, fmt.Errorf("%w: %q", errUnsupportedAdmissionReview, gvk.GroupVersion())
+	}
+}
+
+// encodeAdmissionReview encodes the response in an AdmissionReview of the given version.
+func encodeAdmissionReview(gvk schema.GroupVersionKind, response *admissionv1.AdmissionResponse) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{Kind: gvk.Kind, APIVersion: gvk.GroupVersion().String()}
+	if gvk.GroupVersion() != admissionv1beta1.SchemeGroupVersion {
+		return json.Marshal(admissionv1.AdmissionReview{TypeMeta: typeMeta, Response: response})
+	}
+
+	converted := &admissionv1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+	if response.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*response.PatchType)
+		converted.PatchType = &patchType
+	}
+	return json.Marshal(admissionv1beta1.AdmissionReview{TypeMeta: typeMeta, Response: converted})
+}
+
+// requestUID returns the UID of the request of an AdmissionReview that could not be decoded, if it can be read at all.
+func requestUID(body []byte) types.UID {
+	var review struct {
+		Request *struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		return ""
+	}
+	return review.Request.UID
+}
+
+// dryRunKey is the context key flagging the admission requests that are dry runs.
+type dryRunKey struct{}
+
+// withDryRun returns a context flagged as a dry run when the admission request is one.
+func withDryRun(ctx context.Context, req *admissionv1.AdmissionRequest) context.Context {
+	if req.DryRun == nil || !*req.DryRun {
+		return ctx
+	}
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// isDryRun returns whether the context is the one of a dry run. Dry runs must not have side effects: the Kubernetes
+// API can be read, but the caches are not written and nothing else is changed, so that the patch is the same.
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// admissionAudit describes the mutation of a pod, for the audit annotations and warnings of the admission response.
+type admissionAudit struct {
+	// skipReason is why the pod was not mutated at all.
+	skipReason string
+	// injected are the names of the variables added or replaced, sorted.
+	injected []string
+	// skippedContainers holds, by container name, why the container was not mutated.
+	skippedContainers map[string]string
+	// defined are the container/variable pairs already defined in the containers, handled by conflictPolicy.
+	defined        []string
+	conflictPolicy ConflictPolicy
+	// unsupportedOwner is the kind of the owner of the pod when its workload name can't be injected.
+	unsupportedOwner string
+}
+
+// annotations returns the audit annotations describing the mutation, or nil when there is nothing to tell.
+func (a *admissionAudit) annotations() map[string]string {
+	if a == nil {
+		return nil
+	}
+
+	annotations := map[string]string{}
+	if a.skipReason != "" {
+		annotations[auditAnnotationSkipReason] = a.skipReason
+	}
+	if len(a.injected) > 0 {
+		annotations[auditAnnotationInjectedVariables] = strings.Join(a.injected, ",")
+	}
+	if len(a.skippedContainers) > 0 {
+		skipped := make([]string, 0, len(a.skippedContainers))
+		for _, name := range slices.Sorted(maps.Keys(a.skippedContainers)) {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", name, a.skippedContainers[name]))
+		}
+		annotations[auditAnnotationSkippedContainers] = strings.Join(skipped, ",")
+	}
+	if len(a.defined) > 0 {
+		annotations[auditAnnotationConflictingVariables] = strings.Join(a.defined, ",")
+	}
+
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
+// warnings returns the warnings shown to the user about the variables that are already defined and the owners that
+// are not supported.
+func (a *admissionAudit) warnings() []string {
+	if a == nil {
+		return nil
+	}
+
+	var warnings []string
+	if len(a.defined) > 0 {
+		outcome := "kept"
+		if a.conflictPolicy == ConflictPolicyReplace {
+			outcome = "replaced"
+		}
+		warnings = append(warnings, summaryWarning(
+			fmt.Sprintf("New Relic metadata variables already defined were %s (%d)", outcome, len(a.defined)), a.defined))
+	}
+	if a.unsupportedOwner != "" {
+		warnings = append(warnings, truncateWarning(fmt.Sprintf(
+			"New Relic metadata of pods owned by a %s don't include the name of their workload", a.unsupportedOwner)))
+	}
+	return warnings
+}
+
+// summaryWarning returns the message followed by as many of the items as fit in maxWarningLength, and the number of
+// the items left out.
+func summaryWarning(message string, items []string) string {
+	warning := message
+	for i, item := range items {
+		separator := ": "
+		if i > 0 {
+			separator = ", "
+		}
+		// Room is kept to tell how many items are left out after this one.
+		more := ""
+		if left := len(items) - i - 1; left > 0 {
+			more = fmt.Sprintf(", and %d more", left)
+		}
+		if len(warning)+len(separator)+len(item)+len(more) > maxWarningLength {
+			if i > 0 {
+				warning += fmt.Sprintf(", and %d more", len(items)-i)
+			}
+			break
+		}
+		warning += separator + item
+	}
+	return truncateWarning(warning)
+}
+
+// truncateWarning cuts the warning to maxWarningLength, ending it with an ellipsis when it is cut.
+func truncateWarning(warning string) string {
+	runes := []rune(warning)
+	if len(runes) <= maxWarningLength {
+		return warning
+	}
+	return string(runes[:maxWarningLength-3]) + "..."
+}
+
+// errorStatus returns the class of an error preventing the mutation, and the status explaining it.
+func errorStatus(err error) (ErrorClass, *metav1.Status) {
+	if errors.Is(err, errInvalidObject) || errors.Is(err, errInvalidAdmissionReview) || errors.Is(err, errUnsupportedAdmissionReview) {
+		return ErrorClassInvalidObject, failureStatus(http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+	}
+	return ErrorClassInternal, failureStatus(http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("error during mutation: %v", err))
+}
+
+// failureStatus returns the status of a rejected admission request, which the Apiserver shows to the user.
+func failureStatus(code int32, reason metav1.StatusReason, message string) *metav1.Status {
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: message,
+		Reason:  reason,
+		Code:    code,
+	}
+}
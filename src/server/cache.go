@@ -0,0 +1,65 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCacheSweepSize is the number of entries above which expired entries are purged on insertion.
+const ttlCacheSweepSize = 1024
+
+type ttlCacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a minimal concurrency-safe cache whose entries expire after a fixed TTL. It is used to avoid
+// hitting the Kubernetes API on every admission request for objects that rarely change.
+type ttlCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[K]ttlCacheEntry[V]
+	now     func() time.Time
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:     ttl,
+		entries: map[K]ttlCacheEntry[V]{},
+		now:     time.Now,
+	}
+}
+
+// get returns the cached value for the key, if present and not expired.
+func (c *ttlCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// set stores the value for the key for the TTL of the cache.
+func (c *ttlCache[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= ttlCacheSweepSize {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = ttlCacheEntry[V]{value: value, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errCertificateExpired     = errors.New("certificate expired")
+	errCertificateNotYetValid = errors.New("certificate not yet valid")
+	errCertificateEmpty       = errors.New("certificate without data")
+	errCertificateDNSName     = errors.New("certificate not valid for DNS name")
+	errCertificateChain       = errors.New("certificate chain broken")
+)
+
+// Reasons of the rejected certificate reloads, used as label of the certificate reloads metric.
+const (
+	certReloadReasonLoad        = "load"
+	certReloadReasonExpired     = "expired"
+	certReloadReasonNotYetValid = "not_yet_valid"
+	certReloadReasonDNSName     = "dns_name"
+	certReloadReasonChain       = "chain"
+	certReloadReasonSelfSigned  = "self_signed"
+)
+
+// certificateLeaf returns the parsed leaf of the certificate, or nil when the certificate holds no data.
+func certificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing leaf certificate: %w", err)
+	}
+	return leaf, nil
+}
+
+// checkCertificateValidity returns an error when the certificate can't be used at the given time.
+func checkCertificateValidity(leaf *x509.Certificate, now time.Time) error {
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("%w on %s", errCertificateExpired, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("%w until %s", errCertificateNotYetValid, leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validateCertificate checks the certificate can be served at the given time: every certificate of the chain must be
+// valid and signed by the next one, and the leaf must be valid for all the DNS names.
+func validateCertificate(cert *tls.Certificate, dnsNames []string, now time.Time) error {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errCertificateEmpty
+	}
+
+	chain := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parsing certificate %d of the chain: %w", i, err)
+		}
+		if err := checkCertificateValidity(parsed, now); err != nil {
+			return fmt.Errorf("certificate %d of the chain (%s): %w", i, parsed.Subject, err)
+		}
+		chain = append(chain, parsed)
+	}
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return fmt.Errorf("%w: %s is not signed by %s: %w", errCertificateChain, chain[i-1].Subject, chain[i].Subject, err)
+		}
+	}
+
+	for _, name := range dnsNames {
+		if err := chain[0].VerifyHostname(name); err != nil {
+			return fmt.Errorf("%w %s: %w", errCertificateDNSName, name, err)
+		}
+	}
+	return nil
+}
+
+// certReloadReason returns the label of the certificate reloads metric for a rejected reload.
+func certReloadReason(err error) string {
+	switch {
+	case errors.Is(err, errCertificateExpired):
+		return certReloadReasonExpired
+	case errors.Is(err, errCertificateNotYetValid):
+		return certReloadReasonNotYetValid
+	case errors.Is(err, errCertificateDNSName):
+		return certReloadReasonDNSName
+	case errors.Is(err, errCertificateChain):
+		return certReloadReasonChain
+	case errors.Is(err, errSelfSigned):
+		return certReloadReasonSelfSigned
+	default:
+		return certReloadReasonLoad
+	}
+}
+
+// ReloadCert loads the key pair from CertFile and KeyFile and, if it is valid for CertDNSNames, replaces the
+// certificate used by the server. Otherwise the previous certificate is kept and the error is reported by the
+// readiness probe until a reload succeeds.
+func (whsvr *Webhook) ReloadCert() error {
+	pair, err := tls.LoadX509KeyPair(whsvr.CertFile, whsvr.KeyFile)
+	if err == nil {
+		err = validateCertificate(&pair, whsvr.CertDNSNames, time.Now())
+	}
+	whsvr.Metrics.ObserveCertReload(err)
+	if err != nil {
+		err = fmt.Errorf("rejected certificate reload: %w", err)
+		whsvr.Lock()
+		whsvr.certReloadErr = err
+		whsvr.Unlock()
+		return err
+	}
+
+	whsvr.SetCert(&pair)
+	return nil
+}
+
+// SetCert atomically replaces the certificate used by the server and records its expiration.
+func (whsvr *Webhook) SetCert(cert *tls.Certificate) {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		whsvr.Logger.Errorw("can't parse the certificate, its expiration is unknown", "err", err)
+	}
+	if leaf != nil {
+		// Keep the parsed leaf so it is not parsed again by the readiness probe and the expiry monitor.
+		cert.Leaf = leaf
+		whsvr.Metrics.observeCertificate(leaf)
+	}
+
+	whsvr.Lock()
+	defer whsvr.Unlock()
+	whsvr.Cert = cert
+	whsvr.certReloadErr = nil
+}
+
+// ServesCert reports whether the given certificate is the one used by the server.
+func (whsvr *Webhook) ServesCert(cert *tls.Certificate) bool {
+	whsvr.RLock()
+	defer whsvr.RUnlock()
+	if cert == nil || whsvr.Cert == nil {
+		return cert == whsvr.Cert
+	}
+	return slices.EqualFunc(cert.Certificate, whsvr.Cert.Certificate, bytes.Equal)
+}
+
+// certificateLeaf returns the parsed leaf of the certificate used by the server.
+func (whsvr *Webhook) certificateLeaf() (*x509.Certificate, error) {
+	whsvr.RLock()
+	defer whsvr.RUnlock()
+	return certificateLeaf(whsvr.Cert)
+}
+
+// CertExpiryMonitor logs a warning each time the certificate of the webhook gets closer to its expiration than one
+// of the thresholds, and an error once it is expired. Each threshold is only warned once per certificate.
+type CertExpiryMonitor struct {
+	Webhook    *Webhook
+	Thresholds []time.Duration
+
+	mu      sync.Mutex
+	leaf    *x509.Certificate
+	warned  bool
+	nearest time.Duration
+}
+
+// Check compares the expiration of the current certificate with the thresholds at the given time.
+func (m *CertExpiryMonitor) Check(now time.Time) {
+	leaf, err := m.Webhook.certificateLeaf()
+	if err != nil || leaf == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.leaf == nil || !m.leaf.Equal(leaf) {
+		m.leaf, m.warned = leaf, false
+	}
+
+	remaining := leaf.NotAfter.Sub(now)
+	if remaining <= 0 {
+		if !m.warned || m.nearest > 0 {
+			m.Webhook.Logger.Errorw("certificate expired", "notAfter", leaf.NotAfter)
+			m.warned, m.nearest = true, 0
+		}
+		return
+	}
+
+	crossed := false
+	var nearest time.Duration
+	for _, threshold := range m.Thresholds {
+		if remaining <= threshold && (!crossed || threshold < nearest) {
+			crossed, nearest = true, threshold
+		}
+	}
+	if !crossed || (m.warned && nearest >= m.nearest) {
+		return
+	}
+	m.Webhook.Logger.Warnw("certificate about to expire", "notAfter", leaf.NotAfter, "remaining", remaining.Round(time.Second), "threshold", nearest)
+	m.warned, m.nearest = true, nearest
+}
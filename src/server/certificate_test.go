@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestCertificate returns a self-signed certificate valid between notBefore and notAfter. The leaf is not parsed.
+func newTestCertificate(t *testing.T, notBefore, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "nri-metadata-injection"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCheckCertificateValidity(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cases := []struct {
+		desc      string
+		notBefore time.Time
+		notAfter  time.Time
+		err       error
+	}{
+		{desc: "valid", notBefore: now.Add(-time.Hour), notAfter: now.Add(time.Hour)},
+		{desc: "expired", notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(-time.Hour), err: errCertificateExpired},
+		{desc: "not yet valid", notBefore: now.Add(time.Hour), notAfter: now.Add(2 * time.Hour), err: errCertificateNotYetValid},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			t.Parallel()
+			leaf, err := certificateLeaf(newTestCertificate(t, c.notBefore, c.notAfter))
+			require.NoError(t, err)
+			assert.ErrorIs(t, checkCertificateValidity(leaf, now), c.err)
+		})
+	}
+}
+
+func TestSetCert(t *testing.T) {
+	t.Parallel()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	webhook := &Webhook{Metrics: metrics, Logger: zap.NewNop().Sugar()}
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	webhook.SetCert(newTestCertificate(t, time.Now(), notAfter))
+
+	require.NotNil(t, webhook.Cert.Leaf)
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(metrics.certExpiry))
+
+	// A certificate without data, as left by a failed load, is kept without recording anything.
+	webhook.SetCert(&tls.Certificate{})
+	assert.Equal(t, float64(notAfter.Unix()), testutil.ToFloat64(metrics.certExpiry))
+}
+
+func TestCertExpiryMonitor(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.WarnLevel)
+	webhook := &Webhook{Logger: zap.New(core).Sugar()}
+	monitor := &CertExpiryMonitor{Webhook: webhook, Thresholds: []time.Duration{24 * time.Hour, 7 * 24 * time.Hour}}
+
+	now := time.Now()
+	webhook.SetCert(newTestCertificate(t, now.Add(-time.Hour), now.Add(10*24*time.Hour)))
+	monitor.Check(now)
+	assert.Equal(t, 0, logs.Len(), "no threshold crossed")
+
+	monitor.Check(now.Add(4 * 24 * time.Hour))
+	monitor.Check(now.Add(5 * 24 * time.Hour))
+	assert.Equal(t, 1, logs.Len(), "a threshold is warned only once")
+
+	monitor.Check(now.Add(9*24*time.Hour + time.Hour))
+	monitor.Check(now.Add(11 * 24 * time.Hour))
+	monitor.Check(now.Add(12 * 24 * time.Hour))
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+	assert.Equal(t, 7*24*time.Hour, entries[0].ContextMap()["threshold"])
+	assert.Equal(t, 24*time.Hour, entries[1].ContextMap()["threshold"])
+	assert.Equal(t, zapcore.ErrorLevel, entries[2].Level)
+	assert.Equal(t, "certificate expired", entries[2].Message)
+
+	// A renewed certificate is warned again.
+	webhook.SetCert(newTestCertificate(t, now, now.Add(12*time.Hour)))
+	monitor.Check(now)
+	assert.Equal(t, 4, logs.Len())
+}
+
+func TestValidateCertificate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	newPair := func(t *testing.T, template *x509.Certificate, ca *selfSignedPair) *selfSignedPair {
+		t.Helper()
+		if template.NotBefore.IsZero() {
+			template.NotBefore, template.NotAfter = now.Add(-time.Hour), now.Add(time.Hour)
+		}
+		pair, err := generateSelfSignedPair(template, ca)
+		require.NoError(t, err)
+		return pair
+	}
+	root := newPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "root"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	intermediate := newPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "intermediate"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, root)
+	other := newPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	leaf := newPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "webhook"}, DNSNames: []string{"webhook.newrelic.svc"}}, intermediate)
+	expired := newPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "webhook"}, NotBefore: now.Add(-2 * time.Hour), NotAfter: now.Add(-time.Hour)}, intermediate)
+
+	chain := func(pairs ...*selfSignedPair) *tls.Certificate {
+		cert := &tls.Certificate{}
+		for _, pair := range pairs {
+			cert.Certificate = append(cert.Certificate, pair.cert.Raw)
+		}
+		return cert
+	}
+
+	cases := []struct {
+		desc     string
+		cert     *tls.Certificate
+		dnsNames []string
+		err      error
+		reason   string
+	}{
+		{desc: "leaf only", cert: chain(leaf), dnsNames: []string{"webhook.newrelic.svc"}},
+		{desc: "complete chain", cert: chain(leaf, intermediate, root), dnsNames: []string{"webhook.newrelic.svc"}},
+		{desc: "no DNS names expected", cert: chain(leaf)},
+		{desc: "empty", cert: &tls.Certificate{}, err: errCertificateEmpty, reason: certReloadReasonLoad},
+		{desc: "expired leaf", cert: chain(expired, intermediate), err: errCertificateExpired, reason: certReloadReasonExpired},
+		{desc: "broken chain", cert: chain(leaf, other), err: errCertificateChain, reason: certReloadReasonChain},
+		{desc: "intermediate missing", cert: chain(leaf, root), err: errCertificateChain, reason: certReloadReasonChain},
+		{
+			desc:     "DNS name not covered",
+			cert:     chain(leaf),
+			dnsNames: []string{"webhook.newrelic.svc", "webhook.other.svc"},
+			err:      errCertificateDNSName,
+			reason:   certReloadReasonDNSName,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			t.Parallel()
+			err := validateCertificate(c.cert, c.dnsNames, now)
+			assert.ErrorIs(t, err, c.err)
+			if c.err != nil {
+				assert.Equal(t, c.reason, certReloadReason(err))
+			}
+		})
+	}
+}
+
+func TestReloadCert(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	webhook := &Webhook{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		CertDNSNames: []string{"webhook.newrelic.svc"},
+		Metrics:      NewMetrics(prometheus.NewRegistry()),
+		Logger:       zap.NewNop().Sugar(),
+	}
+	writePair := func(t *testing.T, dnsName string) {
+		t.Helper()
+		pair, err := generateSelfSignedPair(&x509.Certificate{
+			Subject:   pkix.Name{CommonName: dnsName},
+			DNSNames:  []string{dnsName},
+			NotBefore: time.Now().Add(-time.Hour),
+			NotAfter:  time.Now().Add(time.Hour),
+		}, nil)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(webhook.CertFile, pair.certPEM, 0o600))
+		require.NoError(t, os.WriteFile(webhook.KeyFile, pair.keyPEM, 0o600))
+	}
+	readiness := func(t *testing.T) (int, string) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		TLSReadyReadinessProbe(webhook).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	writePair(t, "webhook.other.svc")
+	require.ErrorIs(t, webhook.ReloadCert(), errCertificateDNSName)
+	assert.Nil(t, webhook.Cert)
+	code, body := readiness(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "certificate not valid for DNS name webhook.newrelic.svc")
+
+	writePair(t, "webhook.newrelic.svc")
+	require.NoError(t, webhook.ReloadCert())
+	previous := webhook.Cert
+	require.NotNil(t, previous)
+	code, body = readiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "OK", body)
+
+	// A rejected reload keeps the previous certificate, which is still ready.
+	require.NoError(t, os.WriteFile(webhook.KeyFile, []byte("garbage"), 0o600))
+	require.Error(t, webhook.ReloadCert())
+	assert.Same(t, previous, webhook.Cert)
+	code, body = readiness(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "keeping the previous certificate: rejected certificate reload")
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(webhook.Metrics.certReloads.WithLabelValues("success", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(webhook.Metrics.certReloads.WithLabelValues("failure", certReloadReasonDNSName)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(webhook.Metrics.certReloads.WithLabelValues("failure", certReloadReasonLoad)))
+}
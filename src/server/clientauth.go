@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	errClientCANotLoaded    = errors.New("client CA bundle not loaded")
+	errClientCAEmpty        = errors.New("no certificate found in client CA bundle")
+	errClientCertMissing    = errors.New("client certificate required")
+	errClientCertNotAllowed = errors.New("client certificate not allowed")
+)
+
+// ClientAuth verifies the certificates of the clients, usually the API server, against a CA bundle read from a file.
+// The bundle can be reloaded while the server is running, since the verification happens after the handshake
+// rather than through tls.Config.ClientCAs.
+type ClientAuth struct {
+	// CAFile is the PEM file holding the CAs the client certificates must be signed by.
+	CAFile string
+
+	allowed []namePattern
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+// NewClientAuth returns a ClientAuth for the CAs of the given file. When allowedNames is not empty, the subject
+// common name or one of the SANs (DNS names, URIs, emails) of the client certificates must match one of its patterns,
+// which are globs or regular expressions enclosed in slashes. The CAs are not loaded until Reload is called.
+func NewClientAuth(caFile string, allowedNames []string) (*ClientAuth, error) {
+	allowed, err := compileNamePatterns(allowedNames)
+	if err != nil {
+		return nil, fmt.Errorf("allowed client names: %w", err)
+	}
+	return &ClientAuth{CAFile: caFile, allowed: allowed}, nil
+}
+
+// Reload reads the CA bundle from CAFile. On errors the previous bundle is kept.
+func (a *ClientAuth) Reload() error {
+	data, err := os.ReadFile(a.CAFile)
+	if err != nil {
+		return fmt.Errorf("reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("%w %s", errClientCAEmpty, a.CAFile)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pool = pool
+	return nil
+}
+
+// Configure makes the server ask for client certificates and verify them with this ClientAuth.
+func (a *ClientAuth) Configure(config *tls.Config) {
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyConnection = a.VerifyConnection
+}
+
+// VerifyConnection checks the client certificate of the connection is signed by the CAs and allowed.
+func (a *ClientAuth) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errClientCertMissing
+	}
+
+	a.mu.RLock()
+	pool := a.pool
+	a.mu.RUnlock()
+	if pool == nil {
+		return errClientCANotLoaded
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return fmt.Errorf("verifying client certificate %s: %w", leaf.Subject, err)
+	}
+
+	if len(a.allowed) == 0 {
+		return nil
+	}
+	for _, name := range clientNames(leaf) {
+		if matchesAny(a.allowed, name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errClientCertNotAllowed, leaf.Subject)
+}
+
+// ready returns an error while no CA bundle has been loaded, since every client would be rejected.
+func (a *ClientAuth) ready() error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.pool == nil {
+		return errClientCANotLoaded
+	}
+	return nil
+}
+
+// clientNames returns the names identifying the client: the subject common name and the SANs.
+func clientNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return append(names, cert.EmailAddresses...)
+}
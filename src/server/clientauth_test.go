@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClientPKI(t *testing.T) (ca *selfSignedPair, issue func(commonName string, dnsNames ...string) tls.Certificate) {
+	t.Helper()
+	ca, err := generateSelfSignedPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "client-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	require.NoError(t, err)
+
+	return ca, func(commonName string, dnsNames ...string) tls.Certificate {
+		t.Helper()
+		client, err := generateSelfSignedPair(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: commonName},
+			DNSNames:    dnsNames,
+			NotBefore:   time.Now().Add(-time.Hour),
+			NotAfter:    time.Now().Add(time.Hour),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca)
+		require.NoError(t, err)
+		pair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+		require.NoError(t, err)
+		return pair
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	t.Parallel()
+
+	ca, issue := newTestClientPKI(t)
+	otherCA, issueOther := newTestClientPKI(t)
+	caFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.certPEM, 0o600))
+
+	auth, err := NewClientAuth(caFile, []string{"kube-apiserver", "/^apiserver\\..+\\.svc$/"})
+	require.NoError(t, err)
+	require.NoError(t, auth.Reload())
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{}
+	auth.Configure(server.TLS)
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(t *testing.T, cert *tls.Certificate) error {
+		t.Helper()
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	allowedCN, allowedSAN := issue("kube-apiserver"), issue("proxy", "apiserver.kube-system.svc")
+	notAllowed := issue("someone")
+	assert.NoError(t, get(t, &allowedCN), "common name allowed")
+	assert.NoError(t, get(t, &allowedSAN), "SAN allowed")
+	assert.Error(t, get(t, &notAllowed), "name not allowed")
+	assert.Error(t, get(t, nil), "no client certificate")
+	otherCert := issueOther("kube-apiserver")
+	assert.Error(t, get(t, &otherCert), "signed by another CA")
+
+	// A new CA bundle is used as soon as it is reloaded, and a broken one is ignored.
+	require.NoError(t, os.WriteFile(caFile, otherCA.certPEM, 0o600))
+	require.NoError(t, auth.Reload())
+	assert.NoError(t, get(t, &otherCert))
+	assert.Error(t, get(t, &allowedCN))
+
+	require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0o600))
+	assert.ErrorIs(t, auth.Reload(), errClientCAEmpty)
+	assert.NoError(t, get(t, &otherCert))
+}
+
+func TestClientAuth_VerifyConnection(t *testing.T) {
+	t.Parallel()
+
+	ca, issue := newTestClientPKI(t)
+	caFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.certPEM, 0o600))
+	auth, err := NewClientAuth(caFile, nil)
+	require.NoError(t, err)
+
+	client := issue("anyone")
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.Leaf}}
+	assert.ErrorIs(t, auth.VerifyConnection(state), errClientCANotLoaded)
+	assert.ErrorIs(t, auth.ready(), errClientCANotLoaded)
+
+	require.NoError(t, auth.Reload())
+	assert.NoError(t, auth.VerifyConnection(state), "any name is allowed without patterns")
+	assert.ErrorIs(t, auth.VerifyConnection(tls.ConnectionState{}), errClientCertMissing)
+	assert.NoError(t, auth.ready())
+
+	_, err = NewClientAuth(caFile, []string{"/[/"})
+	assert.Error(t, err)
+}
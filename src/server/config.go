@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	errVariableWithoutName     = errors.New("variable without name")
+	errDuplicatedVariable      = errors.New("duplicated variable")
+	errMultipleVariableSources = errors.New("only one of value, fieldRef, resourceFieldRef or template can be set")
+	errEmptyFieldPath          = errors.New("fieldRef without fieldPath")
+	errEmptyResource           = errors.New("resourceFieldRef without resource")
+	errEmptyContainerRule      = errors.New("rule without name nor image")
+	errUnknownConflictPolicy   = errors.New("unknown conflict policy")
+	errUnknownErrorClass       = errors.New("unknown error class")
+	errUnknownFailurePolicy    = errors.New("unknown failure policy")
+)
+
+// ConflictPolicy defines how the variables to inject that are already defined in a container are handled.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicySkip keeps the variable defined in the container.
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyReplace replaces the variable defined in the container with the injected one.
+	ConflictPolicyReplace ConflictPolicy = "replace"
+	// ConflictPolicyFail rejects the admission of the pod.
+	ConflictPolicyFail ConflictPolicy = "fail"
+)
+
+// ErrorClass groups the errors preventing the mutation of a pod, to decide whether it is admitted anyway.
+type ErrorClass string
+
+const (
+	// ErrorClassInvalidObject is a pod missing from the admission request or that can't be decoded.
+	ErrorClassInvalidObject ErrorClass = "invalidObject"
+	// ErrorClassInternal is any other error of the webhook, like a patch that can't be built.
+	ErrorClassInternal ErrorClass = "internal"
+)
+
+// FailurePolicy defines whether a pod that can't be mutated because of an error is admitted.
+type FailurePolicy string
+
+const (
+	// FailurePolicyAllow admits the pod without mutating it, with a warning explaining the error.
+	FailurePolicyAllow FailurePolicy = "allow"
+	// FailurePolicyDeny rejects the admission of the pod.
+	FailurePolicyDeny FailurePolicy = "deny"
+)
+
+// InjectionConfig declares what the webhook injects in the pods. It is read from a YAML file, and every setting
+// missing in the file keeps its default value.
+type InjectionConfig struct {
+	// ClusterName overrides the cluster name the webhook was started with.
+	ClusterName string `json:"clusterName,omitempty"`
+	// IgnoredNamespaces are the namespaces whose pods are never mutated. Entries are globs like `openshift-*`, or
+	// regular expressions when enclosed in slashes like `/^gke-.+$/`.
+	IgnoredNamespaces []string `json:"ignoredNamespaces"`
+	// NamespaceSelector restricts the mutation to the pods of the namespaces whose labels match it.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// OptIn restricts the mutation to the pods annotated with `metadata-injection.newrelic.com/inject: "true"`.
+	OptIn bool `json:"optIn,omitempty"`
+	// Containers selects the containers of the pods that are mutated.
+	Containers ContainerFilters `json:"containers,omitempty"`
+	// Variables are the environment variables injected in every mutated container, in order.
+	Variables []VariableConfig `json:"variables"`
+	// PodIdentity are the opt-in pod identity fields injected after the Variables, like uid or podIP.
+	PodIdentity []PodIdentityField `json:"podIdentity,omitempty"`
+	// ContainerResources are the opt-in resources of the containers injected after the PodIdentity, by resource
+	// (requests.cpu, limits.cpu, requests.memory or limits.memory) with the divisor of their values, like 1m or 1Mi.
+	ContainerResources map[string]resource.Quantity `json:"containerResources,omitempty"`
+	// Naming selects the names of the injected metadata variables, globally and by namespace.
+	Naming NamingConfig `json:"naming,omitempty"`
+	// OpenTelemetry also injects OTEL_RESOURCE_ATTRIBUTES with the Kubernetes resource attributes matching the
+	// metadata variables, merged with the attributes already defined in the containers.
+	OpenTelemetry bool `json:"openTelemetry,omitempty"`
+	// Mode selects whether the metadata is injected as environment variables (env, the default), mounted as the files
+	// of a downwardAPI volume (volume), or both.
+	Mode InjectionMode `json:"mode,omitempty"`
+	// Volume configures the metadata volume of the volume and both modes.
+	Volume VolumeConfig `json:"volume,omitempty"`
+	// ConflictPolicy defines how the variables already defined in the containers are handled.
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+	// ErrorPolicy defines by error class whether the pods that can't be mutated are admitted. The classes missing
+	// are allowed. Conflicts are handled by the ConflictPolicy instead.
+	ErrorPolicy map[ErrorClass]FailurePolicy `json:"errorPolicy,omitempty"`
+
+	ignoredNamespaces []namePattern
+	namespaceSelector labels.Selector
+}
+
+// ContainerFilters selects the containers that are mutated: the ones matching any Include rule, or all of them when
+// there is none, except the ones matching any Exclude rule.
+type ContainerFilters struct {
+	Include []ContainerRule `json:"include,omitempty"`
+	Exclude []ContainerRule `json:"exclude,omitempty"`
+}
+
+// ContainerRule matches the containers by name and image. Both are globs like `*-proxy`, or regular expressions when
+// enclosed in slashes like `/proxyv2/`. A rule setting both matches the containers matching both.
+type ContainerRule struct {
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image,omitempty"`
+
+	name  *namePattern
+	image *namePattern
+}
+
+// VariableConfig declares an environment variable to inject and the source of its value, which is one of:
+//   - value: a literal string.
+//   - fieldRef: a downward API field of the pod, like `status.hostIP`.
+//   - resourceFieldRef: a resource of the container, like `limits.cpu`. The container name defaults to the mutated one.
+//     Not injected in the ephemeral containers, which have no resources.
+//   - template: a Go template rendered at admission time over the pod metadata (see variableTemplateData).
+type VariableConfig struct {
+	Name             string                        `json:"name"`
+	Value            string                        `json:"value,omitempty"`
+	FieldRef         *corev1.ObjectFieldSelector   `json:"fieldRef,omitempty"`
+	ResourceFieldRef *corev1.ResourceFieldSelector `json:"resourceFieldRef,omitempty"`
+	Template         string                        `json:"template,omitempty"`
+	// OmitEmpty skips the variable when its value (literal or rendered template) is empty.
+	OmitEmpty bool `json:"omitEmpty,omitempty"`
+
+	template *template.Template
+}
+
+// variableTemplateData is the data available to the templates of the injected variables, e.g.
+// `{{ .Pod.Namespace }}`, `{{ index .Pod.Labels "app.kubernetes.io/name" }}` or `{{ .Container.Image }}`.
+type variableTemplateData struct {
+	ClusterName string
+	Pod         *metav1.ObjectMeta
+	Container   *corev1.Container
+	Owners      workloadOwners
+}
+
+// DefaultInjectionConfig returns the configuration injecting the default New Relic metadata variables.
+func DefaultInjectionConfig() *InjectionConfig {
+	config := &InjectionConfig{
+		IgnoredNamespaces: ignoredNamespaces,
+		ConflictPolicy:    ConflictPolicySkip,
+		Mode:              InjectionModeEnv,
+		Volume:            VolumeConfig{MountPath: defaultMetadataMountPath},
+		Naming:            NamingConfig{Profiles: []NamingProfile{NamingProfileNewRelic}},
+		Variables: []VariableConfig{
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", Template: "{{ .ClusterName }}"},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_NODE_NAME", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_POD_NAME", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", Template: "{{ .Container.Name }}"},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_CONTAINER_IMAGE_NAME", Template: "{{ .Container.Image }}"},
+		},
+	}
+	if err := config.Compile(); err != nil {
+		panic(fmt.Sprintf("invalid default injection config: %v", err))
+	}
+	return config
+}
+
+// defaultInjectionConfig is used by the webhooks without an explicit configuration.
+var defaultInjectionConfig = sync.OnceValue(DefaultInjectionConfig)
+
+// LoadInjectionConfig reads and validates the injection configuration from the given YAML file. The settings missing
+// in the file are taken from the given defaults, or from DefaultInjectionConfig when nil.
+func LoadInjectionConfig(path string, defaults *InjectionConfig) (*InjectionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading injection config: %w", err)
+	}
+	return ParseInjectionConfig(data, defaults)
+}
+
+// ParseInjectionConfig parses and validates an injection configuration in YAML format. The settings missing in the
+// data are taken from the given defaults, or from DefaultInjectionConfig when nil.
+func ParseInjectionConfig(data []byte, defaults *InjectionConfig) (*InjectionConfig, error) {
+	if defaults == nil {
+		defaults = DefaultInjectionConfig()
+	}
+
+	// The file is not decoded on top of the defaults, since decoding a list into an existing one merges the elements.
+	config := &InjectionConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("parsing injection config: %w", err)
+	}
+	config.setDefaults(defaults)
+	if err := config.Compile(); err != nil {
+		return nil, fmt.Errorf("validating injection config: %w", err)
+	}
+	return config, nil
+}
+
+// setDefaults copies the settings missing in the configuration from the given defaults. The defaults are shared by
+// the configurations loaded concurrently with the mutations, so they are cloned rather than referenced: compiling the
+// configuration writes into its variables.
+func (c *InjectionConfig) setDefaults(defaults *InjectionConfig) {
+	if c.IgnoredNamespaces == nil {
+		c.IgnoredNamespaces = slices.Clone(defaults.IgnoredNamespaces)
+	}
+	if c.ConflictPolicy == "" {
+		c.ConflictPolicy = defaults.ConflictPolicy
+	}
+	if c.Variables == nil {
+		c.Variables = slices.Clone(defaults.Variables)
+	}
+	if c.PodIdentity == nil {
+		c.PodIdentity = slices.Clone(defaults.PodIdentity)
+	}
+	if c.Mode == "" {
+		c.Mode = defaults.Mode
+	}
+	if c.Volume.MountPath == "" {
+		c.Volume.MountPath = defaults.Volume.MountPath
+	}
+	if c.ContainerResources == nil {
+		c.ContainerResources = maps.Clone(defaults.ContainerResources)
+	}
+	if c.Naming.Profiles == nil {
+		c.Naming.Profiles = slices.Clone(defaults.Naming.Profiles)
+	}
+	if c.Naming.CustomPrefix == "" {
+		c.Naming.CustomPrefix = defaults.Naming.CustomPrefix
+	}
+	// A missing openTelemetry can't be told apart from false, so the file can only enable it.
+	if !c.OpenTelemetry {
+		c.OpenTelemetry = defaults.OpenTelemetry
+	}
+	if c.ErrorPolicy == nil {
+		c.ErrorPolicy = maps.Clone(defaults.ErrorPolicy)
+	}
+	for class, policy := range defaults.ErrorPolicy {
+		if _, ok := c.ErrorPolicy[class]; !ok {
+			c.ErrorPolicy[class] = policy
+		}
+	}
+}
+
+// failurePolicy returns the policy of the given error class.
+func (c *InjectionConfig) failurePolicy(class ErrorClass) FailurePolicy {
+	if policy, ok := c.ErrorPolicy[class]; ok {
+		return policy
+	}
+	return FailurePolicyAllow
+}
+
+// Compile validates the configuration and parses its patterns and templates. It must be called after modifying the
+// configuration and before using it.
+func (c *InjectionConfig) Compile() error {
+	switch c.ConflictPolicy {
+	case "", ConflictPolicySkip, ConflictPolicyReplace, ConflictPolicyFail:
+	default:
+		return fmt.Errorf("%w: %q", errUnknownConflictPolicy, c.ConflictPolicy)
+	}
+	for class, policy := range c.ErrorPolicy {
+		switch class {
+		case ErrorClassInvalidObject, ErrorClassInternal:
+		default:
+			return fmt.Errorf("errorPolicy: %w %q, expected %s or %s", errUnknownErrorClass, class, ErrorClassInvalidObject, ErrorClassInternal)
+		}
+		switch policy {
+		case FailurePolicyAllow, FailurePolicyDeny:
+		default:
+			return fmt.Errorf("errorPolicy: %w %q for %s", errUnknownFailurePolicy, policy, class)
+		}
+	}
+
+	if err := c.Naming.compile(); err != nil {
+		return fmt.Errorf("naming: %w", err)
+	}
+	switch c.Mode {
+	case "", InjectionModeEnv, InjectionModeVolume, InjectionModeBoth:
+	default:
+		return fmt.Errorf("%w %q, expected %s, %s or %s", errUnknownInjectionMode, c.Mode,
+			InjectionModeEnv, InjectionModeVolume, InjectionModeBoth)
+	}
+	if err := c.Volume.compile(); err != nil {
+		return fmt.Errorf("volume: %w", err)
+	}
+
+	ignored, err := compileNamePatterns(c.IgnoredNamespaces)
+	if err != nil {
+		return fmt.Errorf("ignoredNamespaces: %w", err)
+	}
+	c.ignoredNamespaces = ignored
+
+	c.namespaceSelector = nil
+	if err := c.Containers.compile(); err != nil {
+		return fmt.Errorf("containers: %w", err)
+	}
+
+	if c.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(c.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("namespaceSelector: %w", err)
+		}
+		c.namespaceSelector = selector
+	}
+
+	names := map[string]bool{}
+	for i := range c.Variables {
+		variable := &c.Variables[i]
+		if variable.Name == "" {
+			return fmt.Errorf("variable %d: %w", i, errVariableWithoutName)
+		}
+		if names[variable.Name] || (c.OpenTelemetry && variable.Name == otelResourceAttributesVar) ||
+			(c.mountsVolume() && variable.Name == metadataFileVar) {
+			return fmt.Errorf("%w: %s", errDuplicatedVariable, variable.Name)
+		}
+		names[variable.Name] = true
+
+		if err := variable.compile(); err != nil {
+			return fmt.Errorf("variable %s: %w", variable.Name, err)
+		}
+	}
+
+	identityNames, err := podIdentityVariableNames(c.PodIdentity)
+	if err != nil {
+		return fmt.Errorf("podIdentity: %w", err)
+	}
+	for _, name := range identityNames {
+		if names[name] {
+			return fmt.Errorf("podIdentity: %w: %s", errDuplicatedVariable, name)
+		}
+	}
+
+	resourceNames, err := containerResourceVariableNames(c.ContainerResources)
+	if err != nil {
+		return fmt.Errorf("containerResources: %w", err)
+	}
+	for _, name := range resourceNames {
+		if names[name] {
+			return fmt.Errorf("containerResources: %w: %s", errDuplicatedVariable, name)
+		}
+	}
+	return nil
+}
+
+func (f *ContainerFilters) compile() error {
+	for i := range f.Include {
+		if err := f.Include[i].compile(); err != nil {
+			return fmt.Errorf("include rule %d: %w", i, err)
+		}
+	}
+	for i := range f.Exclude {
+		if err := f.Exclude[i].compile(); err != nil {
+			return fmt.Errorf("exclude rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *ContainerRule) compile() error {
+	if r.Name == "" && r.Image == "" {
+		return errEmptyContainerRule
+	}
+
+	r.name, r.image = nil, nil
+	if r.Name != "" {
+		pattern, err := compileNamePattern(r.Name)
+		if err != nil {
+			return err
+		}
+		r.name = &pattern
+	}
+	if r.Image != "" {
+		pattern, err := compileNamePattern(r.Image)
+		if err != nil {
+			return err
+		}
+		r.image = &pattern
+	}
+	return nil
+}
+
+func (v *VariableConfig) compile() error {
+	sources := 0
+	for _, set := range []bool{v.Value != "", v.FieldRef != nil, v.ResourceFieldRef != nil, v.Template != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errMultipleVariableSources
+	}
+
+	if v.FieldRef != nil && v.FieldRef.FieldPath == "" {
+		return errEmptyFieldPath
+	}
+	if v.ResourceFieldRef != nil && v.ResourceFieldRef.Resource == "" {
+		return errEmptyResource
+	}
+
+	v.template = nil
+	if v.Template != "" {
+		tmpl, err := template.New(v.Name).Option("missingkey=zero").Parse(v.Template)
+		if err != nil {
+			return fmt.Errorf("parsing template: %w", err)
+		}
+		v.template = tmpl
+	}
+	return nil
+}
+
+// envVar returns the environment variable declared by the config for the given container. It returns false when
+// the variable must be omitted.
+func (v *VariableConfig) envVar(data *variableTemplateData) (corev1.EnvVar, bool, error) {
+	switch {
+	case v.FieldRef != nil:
+		envVar := createEnvVarFromFieldPath(v.Name, v.FieldRef.FieldPath)
+		envVar.ValueFrom.FieldRef.APIVersion = v.FieldRef.APIVersion
+		return envVar, true, nil
+	case v.ResourceFieldRef != nil:
+		selector := v.ResourceFieldRef.DeepCopy()
+		if selector.ContainerName == "" {
+			selector.ContainerName = data.Container.Name
+		}
+		return corev1.EnvVar{Name: v.Name, ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: selector}}, true, nil
+	case v.template != nil:
+		var value bytes.Buffer
+		if err := v.template.Execute(&value, data); err != nil {
+			return corev1.EnvVar{}, false, fmt.Errorf("rendering template of %s: %w", v.Name, err)
+		}
+		return createEnvVarFromString(v.Name, value.String()), value.Len() > 0 || !v.OmitEmpty, nil
+	default:
+		return createEnvVarFromString(v.Name, v.Value), v.Value != "" || !v.OmitEmpty, nil
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseInjectionConfig(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+variables:
+  - name: NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME
+    template: "{{ .ClusterName }}"
+  - name: NEW_RELIC_METADATA_KUBERNETES_POD_UID
+    fieldRef:
+      fieldPath: metadata.uid
+  - name: NEW_RELIC_METADATA_KUBERNETES_HOST_IP
+    fieldRef:
+      fieldPath: status.hostIP
+  - name: NEW_RELIC_METADATA_KUBERNETES_CPU_LIMIT
+    resourceFieldRef:
+      resource: limits.cpu
+      divisor: 1m
+  - name: TEAM
+    template: '{{ index .Pod.Labels "team" }}'
+    omitEmpty: true
+  - name: ENVIRONMENT
+    value: production
+`), nil)
+	require.NoError(t, err)
+
+	data := &variableTemplateData{
+		ClusterName: "my-cluster",
+		Pod:         &metav1.ObjectMeta{Name: "pod", Labels: map[string]string{"team": "core"}},
+		Container:   &corev1.Container{Name: "app"},
+	}
+
+	var vars []corev1.EnvVar
+	for i := range config.Variables {
+		envVar, ok, err := config.Variables[i].envVar(data)
+		require.NoError(t, err)
+		if ok {
+			vars = append(vars, envVar)
+		}
+	}
+
+	assert.Equal(t, []corev1.EnvVar{
+		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "my-cluster"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_UID", "metadata.uid"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_HOST_IP", "status.hostIP"),
+		{Name: "NEW_RELIC_METADATA_KUBERNETES_CPU_LIMIT", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+			ContainerName: "app", Resource: "limits.cpu", Divisor: resource.MustParse("1m"),
+		}}},
+		createEnvVarFromString("TEAM", "core"),
+		createEnvVarFromString("ENVIRONMENT", "production"),
+	}, vars)
+
+	t.Run("template rendering empty is omitted", func(t *testing.T) {
+		t.Parallel()
+
+		_, ok, err := config.Variables[4].envVar(&variableTemplateData{Pod: &metav1.ObjectMeta{}, Container: &corev1.Container{}})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
+
+func TestParseInjectionConfig_Defaults(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(``), nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultInjectionConfig().Variables, config.Variables)
+}
+
+func TestParseInjectionConfig_Invalid(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"unknown field":          "foo: bar",
+		"missing name":           "variables: [{value: foo}]",
+		"duplicated name":        "variables: [{name: FOO, value: foo}, {name: FOO, value: bar}]",
+		"multiple sources":       "variables: [{name: FOO, value: foo, fieldRef: {fieldPath: metadata.name}}]",
+		"empty field path":       "variables: [{name: FOO, fieldRef: {}}]",
+		"empty resource":         "variables: [{name: FOO, resourceFieldRef: {}}]",
+		"malformed template":     "variables: [{name: FOO, template: '{{ .ClusterName '}]",
+		"invalid selector":       "namespaceSelector: {matchExpressions: [{key: foo, operator: Like}]}",
+		"empty container rule":   "containers: {exclude: [{}]}",
+		"invalid container rule": "containers: {include: [{image: '/[a-/'}]}",
+		"unknown error class":    "errorPolicy: {timeout: deny}",
+		"duplicated otel var":    "{openTelemetry: true, variables: [{name: OTEL_RESOURCE_ATTRIBUTES, value: foo}]}",
+		"unknown naming profile": "naming: {profiles: [datadog]}",
+		"missing custom prefix":  "naming: {profiles: [custom]}",
+		"invalid custom prefix":  "naming: {profiles: [custom], customPrefix: 'ACME-'}",
+		"naming rule without ns": "naming: {namespaces: [{profiles: [generic]}]}",
+		"naming rule no profile": "naming: {namespaces: [{namespaces: [team-a]}]}",
+		"unknown identity field": "podIdentity: [nodeIP]",
+		"duplicated identity":    "{podIdentity: [uid], variables: [{name: NEW_RELIC_METADATA_KUBERNETES_POD_UID, fieldRef: {fieldPath: metadata.uid}}]}",
+		"unknown failure policy": "errorPolicy: {internal: ignore}",
+		"unknown resource":       "containerResources: {limits.storage: 1}",
+		"invalid divisor":        "containerResources: {requests.memory: 1m}",
+		"invalid quantity":       "containerResources: {limits.cpu: lots}",
+		"unknown mode":           "mode: files",
+		"relative mount path":    "volume: {mountPath: metadata}",
+		"duplicated file var":    "{mode: both, variables: [{name: NEW_RELIC_METADATA_FILE, value: /tmp/metadata.json}]}",
+		"duplicated resource":    "{containerResources: {limits.cpu: 1m}, variables: [{name: NEW_RELIC_METADATA_KUBERNETES_CONTAINER_CPU_LIMIT, value: '1'}]}",
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParseInjectionConfig([]byte(data), nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseInjectionConfig_ClusterNameAndIgnoredNamespaces(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+clusterName: production
+ignoredNamespaces: [kube-system, monitoring]
+`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "production", config.ClusterName)
+	assert.Equal(t, []string{"kube-system", "monitoring"}, config.IgnoredNamespaces)
+
+	defaults, err := ParseInjectionConfig([]byte(`clusterName: production`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, ignoredNamespaces, defaults.IgnoredNamespaces)
+}
+
+func TestParseInjectionConfig_WithDefaults(t *testing.T) {
+	t.Parallel()
+
+	defaults := DefaultInjectionConfig()
+	defaults.IgnoredNamespaces = []string{"openshift-*"}
+	require.NoError(t, defaults.Compile())
+
+	config, err := ParseInjectionConfig([]byte(`clusterName: production`), defaults)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"openshift-*"}, config.IgnoredNamespaces)
+	assert.True(t, matchesAny(config.ignoredNamespaces, "openshift-monitoring"))
+
+	overridden, err := ParseInjectionConfig([]byte(`ignoredNamespaces: []`), defaults)
+	require.NoError(t, err)
+	assert.Empty(t, overridden.ignoredNamespaces)
+}
+
+func TestParseInjectionConfig_OpenTelemetryDefault(t *testing.T) {
+	t.Parallel()
+
+	defaults := DefaultInjectionConfig()
+	defaults.OpenTelemetry = true
+	require.NoError(t, defaults.Compile())
+
+	config, err := ParseInjectionConfig([]byte(`clusterName: production`), defaults)
+	require.NoError(t, err)
+	assert.True(t, config.OpenTelemetry)
+
+	config, err = ParseInjectionConfig([]byte(`openTelemetry: true`), nil)
+	require.NoError(t, err)
+	assert.True(t, config.OpenTelemetry)
+}
+
+func TestParseInjectionConfig_ErrorPolicy(t *testing.T) {
+	t.Parallel()
+
+	defaults := DefaultInjectionConfig()
+	defaults.ErrorPolicy = map[ErrorClass]FailurePolicy{ErrorClassInvalidObject: FailurePolicyDeny}
+	require.NoError(t, defaults.Compile())
+
+	config, err := ParseInjectionConfig([]byte(`errorPolicy: {internal: deny}`), defaults)
+	require.NoError(t, err)
+	assert.Equal(t, FailurePolicyDeny, config.failurePolicy(ErrorClassInvalidObject))
+	assert.Equal(t, FailurePolicyDeny, config.failurePolicy(ErrorClassInternal))
+
+	config, err = ParseInjectionConfig([]byte(`errorPolicy: {invalidObject: allow}`), defaults)
+	require.NoError(t, err)
+	assert.Equal(t, FailurePolicyAllow, config.failurePolicy(ErrorClassInvalidObject))
+	assert.Equal(t, FailurePolicyAllow, config.failurePolicy(ErrorClassInternal))
+}
+
+func TestContainerFilters(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+containers:
+  exclude:
+    - name: istio-proxy
+    - name: linkerd-proxy
+    - image: "/cloudsql-proxy/"
+`), nil)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		container corev1.Container
+		expected  bool
+	}{
+		"application":       {container: corev1.Container{Name: "app", Image: "app:1.0.0"}, expected: true},
+		"istio sidecar":     {container: corev1.Container{Name: "istio-proxy", Image: "istio/proxyv2:1.20.0"}, expected: false},
+		"linkerd sidecar":   {container: corev1.Container{Name: "linkerd-proxy", Image: "linkerd/proxy:stable"}, expected: false},
+		"excluded by image": {container: corev1.Container{Name: "db-proxy", Image: "gcr.io/cloudsql-docker/gce-proxy/cloudsql-proxy:2"}, expected: false},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, c.expected, config.Containers.selects(&c.container))
+		})
+	}
+}
+
+func TestParseInjectionConfig_ReloadWhileMutating(t *testing.T) {
+	t.Parallel()
+
+	// The defaults are shared by every reload, as in the webhook server, so compiling the reloaded configuration must
+	// not write into them while the mutations read the configuration in use. Run with -race.
+	defaults := DefaultInjectionConfig()
+	whsvr := &Webhook{ClusterName: "foobar", Config: defaults, Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			config, err := ParseInjectionConfig([]byte(`conflictPolicy: replace`), defaults)
+			if !assert.NoError(t, err) {
+				return
+			}
+			whsvr.SetConfig(config)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			_, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, whsvr.injectionConfig()))
+			require.NoError(t, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EnvFromResolver gets the keys of the ConfigMaps and Secrets referenced in the envFrom of the containers from the
+// Kubernetes API, so the variables they define are known when injecting. Only the keys are kept, never the values,
+// and they are cached to avoid API calls per admission request.
+type EnvFromResolver struct {
+	// IgnoreSecrets skips the Secrets, whose keys are then unknown, so the webhook doesn't need to read them.
+	IgnoreSecrets bool
+
+	client kubernetes.Interface
+	cache  *ttlCache[string, []string]
+}
+
+// NewEnvFromResolver returns an EnvFromResolver using the given client and caching the keys for the given TTL.
+func NewEnvFromResolver(client kubernetes.Interface, cacheTTL time.Duration) *EnvFromResolver {
+	return &EnvFromResolver{
+		client: client,
+		cache:  newTTLCache[string, []string](cacheTTL),
+	}
+}
+
+// variables returns the names of the variables defined by the envFrom sources of the container, with their prefix.
+func (r *EnvFromResolver) variables(ctx context.Context, namespace string, container *corev1.Container) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, source := range container.EnvFrom {
+		keys, err := r.keys(ctx, namespace, source)
+		if err != nil {
+			return names, err
+		}
+		for _, key := range keys {
+			names[source.Prefix+key] = true
+		}
+	}
+	return names, nil
+}
+
+// keys returns the keys of the ConfigMap or Secret referenced by the source. Missing objects have no keys, which are
+// not cached since the objects are often created right after the pod.
+func (r *EnvFromResolver) keys(ctx context.Context, namespace string, source corev1.EnvFromSource) ([]string, error) {
+	var kind, name string
+	switch {
+	case source.ConfigMapRef != nil:
+		kind, name = "configmap", source.ConfigMapRef.Name
+	case source.SecretRef != nil && !r.IgnoreSecrets:
+		kind, name = "secret", source.SecretRef.Name
+	default:
+		return nil, nil
+	}
+
+	cacheKey := kind + "/" + namespace + "/" + name
+	if keys, ok := r.cache.get(cacheKey); ok {
+		return keys, nil
+	}
+
+	var keys []string
+	var err error
+	if kind == "configmap" {
+		keys, err = r.configMapKeys(ctx, namespace, name)
+	} else {
+		keys, err = r.secretKeys(ctx, namespace, name)
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting %s %s/%s: %w", kind, namespace, name, err)
+	}
+
+	if !isDryRun(ctx) {
+		r.cache.set(cacheKey, keys)
+	}
+	return keys, nil
+}
+
+func (r *EnvFromResolver) configMapKeys(ctx context.Context, namespace, name string) ([]string, error) {
+	cm, err := r.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(cm.Data)+len(cm.BinaryData))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	for key := range cm.BinaryData {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *EnvFromResolver) secretKeys(ctx context.Context, namespace, name string) ([]string, error) {
+	secret, err := r.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
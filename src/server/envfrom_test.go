@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEnvFromResolver(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "metadata", Namespace: "default"},
+			Data:       map[string]string{"KUBERNETES_CLUSTER_NAME": "copied", "OTHER": "value"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+			Data:       map[string][]byte{"LICENSE_KEY": []byte("secret")},
+		},
+	)
+	resolver := NewEnvFromResolver(client, time.Minute)
+
+	container := &corev1.Container{
+		Name: "app",
+		EnvFrom: []corev1.EnvFromSource{
+			{Prefix: "NEW_RELIC_METADATA_", ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "metadata"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"}}},
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+		},
+	}
+
+	variables, err := resolver.variables(context.Background(), "default", container)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME": true,
+		"NEW_RELIC_METADATA_OTHER":                   true,
+		"LICENSE_KEY":                                true,
+	}, variables)
+}
+
+func TestEnvFromResolver_IgnoreSecrets(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "default"},
+		Data:       map[string][]byte{"LICENSE_KEY": []byte("secret")},
+	})
+	resolver := NewEnvFromResolver(client, time.Minute)
+	resolver.IgnoreSecrets = true
+
+	container := &corev1.Container{
+		Name:    "app",
+		EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"}}}},
+	}
+
+	variables, err := resolver.variables(context.Background(), "default", container)
+	require.NoError(t, err)
+	assert.Empty(t, variables)
+	assert.Empty(t, client.Actions())
+}
+
+func TestEnvFromResolver_MissingSourceNotCached(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset()
+	resolver := NewEnvFromResolver(client, time.Hour)
+
+	container := &corev1.Container{
+		Name:    "app",
+		EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "metadata"}}}},
+	}
+
+	variables, err := resolver.variables(context.Background(), "default", container)
+	require.NoError(t, err)
+	assert.Empty(t, variables)
+
+	// The ConfigMap created after the pod is seen by the next admission request.
+	_, err = client.CoreV1().ConfigMaps("default").Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "metadata", Namespace: "default"},
+		Data:       map[string]string{"KUBERNETES_CLUSTER_NAME": "copied"},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	variables, err = resolver.variables(context.Background(), "default", container)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"KUBERNETES_CLUSTER_NAME": true}, variables)
+}
+
+func TestUpdateContainer_EnvFromConflicts(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "metadata", Namespace: "default"},
+		Data:       map[string]string{"KUBERNETES_CLUSTER_NAME": "copied"},
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "app",
+			EnvFrom: []corev1.EnvFromSource{{
+				Prefix:       "NEW_RELIC_METADATA_",
+				ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "metadata"}},
+			}},
+		}}},
+	}
+
+	cases := []struct {
+		policy            string
+		expectInjected    bool
+		expectedConflicts []string
+	}{
+		{policy: "skip", expectInjected: false},
+		{policy: "replace", expectInjected: true},
+		{policy: "fail", expectInjected: false, expectedConflicts: []string{"app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			t.Parallel()
+
+			config, err := ParseInjectionConfig([]byte("conflictPolicy: "+c.policy), nil)
+			require.NoError(t, err)
+
+			whsvr := &Webhook{Logger: zap.NewNop().Sugar(), EnvFrom: NewEnvFromResolver(client, time.Minute)}
+			m := whsvr.newPodMutation(context.Background(), pod, config)
+			patches := whsvr.updateContainer(m, containersField, 0, &pod.Spec.Containers[0])
+
+			injected := false
+			for _, patch := range patches {
+				if envVar, ok := patch.Value.(corev1.EnvVar); ok && envVar.Name == "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME" {
+					injected = true
+				}
+				if envVars, ok := patch.Value.([]corev1.EnvVar); ok && envVars[0].Name == "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME" {
+					injected = true
+				}
+			}
+			assert.Equal(t, c.expectInjected, injected)
+			assert.Equal(t, c.expectedConflicts, m.conflicts)
+		})
+	}
+}
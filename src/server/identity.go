@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var errUnknownPodIdentityField = errors.New("unknown pod identity field")
+
+// PodIdentityField is an opt-in field of the pod identity injected along with the metadata.
+type PodIdentityField string
+
+const (
+	// PodIdentityUID is the UID of the pod.
+	PodIdentityUID PodIdentityField = "uid"
+	// PodIdentityPodIP is the primary IP of the pod.
+	PodIdentityPodIP PodIdentityField = "podIP"
+	// PodIdentityPodIPs are the IPs of the pod, comma-separated, for dual-stack clusters.
+	PodIdentityPodIPs PodIdentityField = "podIPs"
+	// PodIdentityHostIP is the primary IP of the node of the pod.
+	PodIdentityHostIP PodIdentityField = "hostIP"
+	// PodIdentityServiceAccountName is the service account of the pod.
+	PodIdentityServiceAccountName PodIdentityField = "serviceAccountName"
+	// PodIdentityPriorityClassName is the priority class of the pod, when it has one.
+	PodIdentityPriorityClassName PodIdentityField = "priorityClassName"
+	// PodIdentityQOSClass is the quality of service class of the pod (Guaranteed, Burstable or BestEffort).
+	PodIdentityQOSClass PodIdentityField = "qosClass"
+)
+
+// podIdentityFields are the variables of the pod identity fields, by order of injection. The ones with a field path
+// come from the downward API, the other ones are computed from the pod spec at admission time.
+var podIdentityFields = []struct {
+	field     PodIdentityField
+	name      string
+	fieldPath string
+}{
+	{PodIdentityUID, newRelicMetadataPrefix + "POD_UID", "metadata.uid"},
+	{PodIdentityPodIP, newRelicMetadataPrefix + "POD_IP", "status.podIP"},
+	{PodIdentityPodIPs, newRelicMetadataPrefix + "POD_IPS", "status.podIPs"},
+	{PodIdentityHostIP, newRelicMetadataPrefix + "HOST_IP", "status.hostIP"},
+	{PodIdentityServiceAccountName, newRelicMetadataPrefix + "SERVICE_ACCOUNT_NAME", "spec.serviceAccountName"},
+	{PodIdentityPriorityClassName, newRelicMetadataPrefix + "PRIORITY_CLASS_NAME", ""},
+	{PodIdentityQOSClass, newRelicMetadataPrefix + "QOS_CLASS", ""},
+}
+
+// podIdentityVariableNames returns the names of the variables of the given fields.
+func podIdentityVariableNames(fields []PodIdentityField) ([]string, error) {
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		found := false
+		for _, identity := range podIdentityFields {
+			if identity.field == field {
+				names = append(names, identity.name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w %q", errUnknownPodIdentityField, field)
+		}
+	}
+	return names, nil
+}
+
+// podIdentityEnvVars returns the variables of the given pod identity fields. The priority class is skipped when the
+// pod has none.
+func podIdentityEnvVars(pod *corev1.Pod, fields []PodIdentityField) []corev1.EnvVar {
+	enabled := make(map[PodIdentityField]bool, len(fields))
+	for _, field := range fields {
+		enabled[field] = true
+	}
+
+	var vars []corev1.EnvVar
+	for _, identity := range podIdentityFields {
+		if !enabled[identity.field] {
+			continue
+		}
+		switch identity.field {
+		case PodIdentityPriorityClassName:
+			if pod.Spec.PriorityClassName != "" {
+				vars = append(vars, createEnvVarFromString(identity.name, pod.Spec.PriorityClassName))
+			}
+		case PodIdentityQOSClass:
+			vars = append(vars, createEnvVarFromString(identity.name, string(podQOSClass(pod))))
+		default:
+			vars = append(vars, createEnvVarFromFieldPath(identity.name, identity.fieldPath))
+		}
+	}
+	return vars
+}
+
+// podQOSClass returns the quality of service class of the pod, computed from the CPU and memory of its containers as
+// the kubelet does. Mutating webhooks running after this one can still change the resources, and so the class.
+func podQOSClass(pod *corev1.Pod) corev1.PodQOSClass {
+	if pod.Status.QOSClass != "" {
+		return pod.Status.QOSClass
+	}
+
+	if pod.Spec.Resources != nil {
+		return qosClassOf([]corev1.ResourceRequirements{*pod.Spec.Resources})
+	}
+	resources := make([]corev1.ResourceRequirements, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for _, container := range pod.Spec.InitContainers {
+		resources = append(resources, container.Resources)
+	}
+	for _, container := range pod.Spec.Containers {
+		resources = append(resources, container.Resources)
+	}
+	return qosClassOf(resources)
+}
+
+// qosClassOf returns the quality of service class of the given resources: Guaranteed when all of them have equal
+// CPU and memory requests and limits, BestEffort when none of them has any, and Burstable otherwise.
+func qosClassOf(resources []corev1.ResourceRequirements) corev1.PodQOSClass {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	guaranteed := true
+	for _, r := range resources {
+		for name, quantity := range r.Requests {
+			if isQOSResource(name) && quantity.Sign() > 0 {
+				addQuantity(requests, name, quantity)
+			}
+		}
+		for name, quantity := range r.Limits {
+			if isQOSResource(name) && quantity.Sign() > 0 {
+				addQuantity(limits, name, quantity)
+			}
+		}
+		if _, ok := r.Limits[corev1.ResourceCPU]; !ok {
+			guaranteed = false
+		}
+		if _, ok := r.Limits[corev1.ResourceMemory]; !ok {
+			guaranteed = false
+		}
+	}
+
+	if len(requests) == 0 && len(limits) == 0 {
+		return corev1.PodQOSBestEffort
+	}
+	if guaranteed {
+		for name, request := range requests {
+			if limit, ok := limits[name]; !ok || limit.Cmp(request) != 0 {
+				guaranteed = false
+				break
+			}
+		}
+	}
+	if guaranteed && len(requests) == len(limits) {
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
+
+func isQOSResource(name corev1.ResourceName) bool {
+	return name == corev1.ResourceCPU || name == corev1.ResourceMemory
+}
+
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, quantity resource.Quantity) {
+	if total, ok := list[name]; ok {
+		total.Add(quantity)
+		list[name] = total
+		return
+	}
+	list[name] = quantity.DeepCopy()
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func resources(requests, limits map[corev1.ResourceName]string) corev1.ResourceRequirements {
+	toList := func(quantities map[corev1.ResourceName]string) corev1.ResourceList {
+		if quantities == nil {
+			return nil
+		}
+		list := corev1.ResourceList{}
+		for name, quantity := range quantities {
+			list[name] = resource.MustParse(quantity)
+		}
+		return list
+	}
+	return corev1.ResourceRequirements{Requests: toList(requests), Limits: toList(limits)}
+}
+
+func TestPodQOSClass(t *testing.T) {
+	t.Parallel()
+
+	cpuAndMemory := map[corev1.ResourceName]string{corev1.ResourceCPU: "500m", corev1.ResourceMemory: "256Mi"}
+	podResources := resources(cpuAndMemory, cpuAndMemory)
+	cases := []struct {
+		name     string
+		spec     corev1.PodSpec
+		expected corev1.PodQOSClass
+	}{
+		{
+			name:     "no resources",
+			spec:     corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			expected: corev1.PodQOSBestEffort,
+		},
+		{
+			name: "only other resources",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:      "app",
+				Resources: resources(map[corev1.ResourceName]string{corev1.ResourceEphemeralStorage: "1Gi"}, nil),
+			}}},
+			expected: corev1.PodQOSBestEffort,
+		},
+		{
+			name: "equal requests and limits",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Resources: resources(cpuAndMemory, cpuAndMemory)}},
+				Containers:     []corev1.Container{{Name: "app", Resources: resources(cpuAndMemory, cpuAndMemory)}},
+			},
+			expected: corev1.PodQOSGuaranteed,
+		},
+		{
+			name: "container without limits",
+			spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "app", Resources: resources(cpuAndMemory, cpuAndMemory)},
+				{Name: "sidecar", Resources: resources(cpuAndMemory, nil)},
+			}},
+			expected: corev1.PodQOSBurstable,
+		},
+		{
+			name: "requests lower than limits",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:      "app",
+				Resources: resources(map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "256Mi"}, cpuAndMemory),
+			}}},
+			expected: corev1.PodQOSBurstable,
+		},
+		{
+			name: "pod-level resources",
+			spec: corev1.PodSpec{
+				Resources:  &podResources,
+				Containers: []corev1.Container{{Name: "app"}},
+			},
+			expected: corev1.PodQOSGuaranteed,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.expected, podQOSClass(&corev1.Pod{Spec: c.spec}))
+		})
+	}
+}
+
+func TestPodIdentityEnvVars(t *testing.T) {
+	t.Parallel()
+
+	all := []PodIdentityField{
+		PodIdentityQOSClass, PodIdentityPriorityClassName, PodIdentityServiceAccountName, PodIdentityHostIP,
+		PodIdentityPodIPs, PodIdentityPodIP, PodIdentityUID,
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{PriorityClassName: "critical", Containers: []corev1.Container{{Name: "app"}}}}
+
+	assert.Equal(t, []corev1.EnvVar{
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_UID", "metadata.uid"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_IP", "status.podIP"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_IPS", "status.podIPs"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_HOST_IP", "status.hostIP"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_SERVICE_ACCOUNT_NAME", "spec.serviceAccountName"),
+		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_PRIORITY_CLASS_NAME", "critical"),
+		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_QOS_CLASS", "BestEffort"),
+	}, podIdentityEnvVars(pod, all))
+
+	// The priority class is not injected when the pod has none.
+	assert.Empty(t, podIdentityEnvVars(&corev1.Pod{}, []PodIdentityField{PodIdentityPriorityClassName}))
+	assert.Empty(t, podIdentityEnvVars(pod, nil))
+}
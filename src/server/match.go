@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// namePattern matches names against a glob like `openshift-*`, or against a regular expression when the pattern is
+// enclosed in slashes like `/^gke-.+$/`. A glob without wildcards is an exact match.
+type namePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func compileNamePattern(pattern string) (namePattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return namePattern{}, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		return namePattern{regexp: re}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return namePattern{}, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return namePattern{glob: pattern}, nil
+}
+
+func compileNamePatterns(patterns []string) ([]namePattern, error) {
+	compiled := make([]namePattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := compileNamePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+func (p namePattern) matches(name string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// matchesAny returns whether the name matches any of the patterns.
+func matchesAny(patterns []namePattern, name string) bool {
+	for _, p := range patterns {
+		if p.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ContainerRule) matches(container *corev1.Container) bool {
+	if r.name != nil && !r.name.matches(container.Name) {
+		return false
+	}
+	if r.image != nil && !r.image.matches(container.Image) {
+		return false
+	}
+	return true
+}
+
+// selects returns whether the container must be mutated according to the filters.
+func (f *ContainerFilters) selects(container *corev1.Container) bool {
+	for i := range f.Exclude {
+		if f.Exclude[i].matches(container) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for i := range f.Include {
+		if f.Include[i].matches(container) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamePatterns(t *testing.T) {
+	t.Parallel()
+
+	patterns, err := compileNamePatterns([]string{"kube-system", "openshift-*", " cattle-* ", "/^gke-[a-z]+$/"})
+	require.NoError(t, err)
+
+	cases := map[string]bool{
+		"kube-system":          true,
+		"kube-system-2":        false,
+		"openshift-monitoring": true,
+		"openshift":            false,
+		"cattle-system":        true,
+		"gke-managed":          true,
+		"gke-managed-2":        false,
+		"default":              false,
+	}
+
+	for name, expected := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, expected, matchesAny(patterns, name))
+		})
+	}
+}
+
+func TestNamePatterns_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := compileNamePatterns([]string{"/[a-/"})
+	assert.Error(t, err)
+
+	_, err = compileNamePatterns([]string{"[a-"})
+	assert.Error(t, err)
+}
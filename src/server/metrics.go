@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/x509"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "nri_metadata_injection"
+
+// Results of the admission requests, used as label of the admission requests metric.
+const (
+	admissionResultMutated    = "mutated"
+	admissionResultNotMutated = "not_mutated"
+	admissionResultDenied     = "denied"
+	admissionResultError      = "error"
+)
+
+// Metrics holds the Prometheus metrics of the webhook. All its methods can be called on a nil *Metrics, which
+// records nothing.
+type Metrics struct {
+	admissionRequests *prometheus.CounterVec
+	mutationsSkipped  *prometheus.CounterVec
+	patchSize         prometheus.Histogram
+	requestDuration   prometheus.Histogram
+	decodeErrors      prometheus.Counter
+	timeouts          prometheus.Counter
+	certReloads       *prometheus.CounterVec
+	certExpiry        prometheus.Gauge
+}
+
+// NewMetrics creates the metrics of the webhook and registers them in the given registerer.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		admissionRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "admission_requests_total",
+			Help:      "Admission requests handled, by operation, namespace and result (mutated, not_mutated, denied, error).",
+		}, []string{"operation", "namespace", "result"}),
+		mutationsSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mutations_skipped_total",
+			Help:      "Pods and containers whose mutation was skipped, by reason.",
+		}, []string{"reason"}),
+		patchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "patch_size_bytes",
+			Help:      "Size of the JSON patches returned to the API server.",
+			Buckets:   prometheus.ExponentialBuckets(256, 2, 8),
+		}),
+		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time spent serving the admission requests.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "decode_errors_total",
+			Help:      "Admission requests whose body could not be decoded.",
+		}),
+		timeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "timeouts_total",
+			Help:      "Admission requests that exceeded the server timeout.",
+		}),
+		certReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "certificate_reloads_total",
+			Help:      "Reloads of the TLS certificate, by result (success, failure) and reason of the failures.",
+		}, []string{"result", "reason"}),
+		certExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "Expiration (NotAfter) of the TLS certificate served, as a Unix timestamp.",
+		}),
+	}
+
+	registerer.MustRegister(
+		m.admissionRequests,
+		m.mutationsSkipped,
+		m.patchSize,
+		m.requestDuration,
+		m.decodeErrors,
+		m.timeouts,
+		m.certReloads,
+		m.certExpiry,
+	)
+	return m
+}
+
+func (m *Metrics) observeAdmission(operation, namespace, result string) {
+	if m == nil {
+		return
+	}
+	m.admissionRequests.WithLabelValues(operation, namespace, result).Inc()
+}
+
+func (m *Metrics) observeSkippedMutation(reason string) {
+	if m == nil {
+		return
+	}
+	m.mutationsSkipped.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) observePatchSize(size int) {
+	if m == nil {
+		return
+	}
+	m.patchSize.Observe(float64(size))
+}
+
+func (m *Metrics) observeRequestDuration(seconds float64) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.Observe(seconds)
+}
+
+func (m *Metrics) observeDecodeError() {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.Inc()
+}
+
+// ObserveTimeout records an admission request that exceeded the server timeout.
+func (m *Metrics) ObserveTimeout() {
+	if m == nil {
+		return
+	}
+	m.timeouts.Inc()
+}
+
+// ObserveCertReload records a reload of the TLS certificate, failed when err is not nil.
+func (m *Metrics) ObserveCertReload(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.certReloads.WithLabelValues("failure", certReloadReason(err)).Inc()
+		return
+	}
+	m.certReloads.WithLabelValues("success", "").Inc()
+}
+
+func (m *Metrics) observeCertificate(leaf *x509.Certificate) {
+	if m == nil {
+		return
+	}
+	m.certExpiry.Set(float64(leaf.NotAfter.Unix()))
+}
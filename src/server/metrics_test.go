@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	server := httptest.NewServer(&Webhook{ClusterName: "foobar", Metrics: metrics})
+	defer server.Close()
+
+	post := func(body []byte) {
+		t.Helper()
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	review := func(namespace string) []byte {
+		t.Helper()
+		raw, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		})
+		require.NoError(t, err)
+		body, err := json.Marshal(admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+			Request: &admissionv1.AdmissionRequest{
+				UID:       types.UID("1"),
+				Operation: admissionv1.Create,
+				Namespace: namespace,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+		require.NoError(t, err)
+		return body
+	}
+
+	post(review("default"))
+	post(review("kube-system"))
+	post([]byte("{"))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.admissionRequests.WithLabelValues("CREATE", "default", admissionResultMutated)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.admissionRequests.WithLabelValues("CREATE", "kube-system", admissionResultNotMutated)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.mutationsSkipped.WithLabelValues(skipReasonIgnoredNamespace)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.decodeErrors))
+	assert.Equal(t, uint64(1), histogramCount(t, metrics.patchSize))
+	assert.Equal(t, uint64(3), histogramCount(t, metrics.requestDuration))
+}
+
+func histogramCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	require.NoError(t, histogram.Write(&metric))
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	t.Parallel()
+
+	var metrics *Metrics
+	assert.NotPanics(t, func() {
+		metrics.observeAdmission("CREATE", "default", admissionResultMutated)
+		metrics.observeSkippedMutation(skipReasonPodAnnotation)
+		metrics.observePatchSize(1)
+		metrics.observeRequestDuration(1)
+		metrics.observeDecodeError()
+		metrics.ObserveTimeout()
+		metrics.ObserveCertReload(nil)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NamespaceResolver gets the labels of the namespaces from the Kubernetes API, since the admission request of a pod
+// only contains the name of its namespace. Lookups are cached to avoid an API call per admission request.
+type NamespaceResolver struct {
+	client kubernetes.Interface
+	cache  *ttlCache[string, labels.Set]
+}
+
+// NewNamespaceResolver returns a NamespaceResolver using the given client and caching the labels for the given TTL.
+func NewNamespaceResolver(client kubernetes.Interface, cacheTTL time.Duration) *NamespaceResolver {
+	return &NamespaceResolver{
+		client: client,
+		cache:  newTTLCache[string, labels.Set](cacheTTL),
+	}
+}
+
+// labels returns the labels of the given namespace.
+func (r *NamespaceResolver) labels(ctx context.Context, namespace string) (labels.Set, error) {
+	if namespaceLabels, ok := r.cache.get(namespace); ok {
+		return namespaceLabels, nil
+	}
+
+	ns, err := r.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting namespace %s: %w", namespace, err)
+	}
+
+	namespaceLabels := labels.Set(ns.Labels)
+	if !isDryRun(ctx) {
+		r.cache.set(namespace, namespaceLabels)
+	}
+	return namespaceLabels, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newRelicMetadataPrefix is the prefix of the metadata variables read by the New Relic agents. The variables named
+// with it are renamed by the naming profiles.
+const newRelicMetadataPrefix = "NEW_RELIC_METADATA_KUBERNETES_"
+
+// genericMetadataPrefix is the prefix of the variables of the generic naming profile.
+const genericMetadataPrefix = "K8S_"
+
+var (
+	errUnknownNamingProfile = errors.New("unknown naming profile")
+	errNoNamingProfile      = errors.New("at least one naming profile is required")
+	errMissingCustomPrefix  = errors.New("the custom naming profile requires a customPrefix")
+	errInvalidCustomPrefix  = errors.New("invalid custom prefix")
+	errEmptyNamingRule      = errors.New("naming rule without namespaces")
+)
+
+// envVarPrefixPattern matches the prefixes that keep the variable names usable from shells.
+var envVarPrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NamingProfile defines the names of the injected metadata variables.
+type NamingProfile string
+
+const (
+	// NamingProfileNewRelic names the variables as read by the New Relic agents, like
+	// NEW_RELIC_METADATA_KUBERNETES_POD_NAME.
+	NamingProfileNewRelic NamingProfile = "newrelic"
+	// NamingProfileGeneric names the variables with the K8S_ prefix, like K8S_POD_NAME.
+	NamingProfileGeneric NamingProfile = "generic"
+	// NamingProfileCustom names the variables with the CustomPrefix of the NamingConfig.
+	NamingProfileCustom NamingProfile = "custom"
+)
+
+// NamingConfig selects the naming profiles of the injected variables. The variables named with the New Relic prefix
+// are injected once per active profile, under its prefix, while the other ones are injected as they are.
+type NamingConfig struct {
+	// Profiles are the profiles active in the namespaces not matching any of the Namespaces rules.
+	Profiles []NamingProfile `json:"profiles,omitempty"`
+	// CustomPrefix is the prefix of the custom profile, like ACME_K8S_.
+	CustomPrefix string `json:"customPrefix,omitempty"`
+	// Namespaces overrides the profiles by namespace. The first rule matching the namespace of the pod applies.
+	Namespaces []NamespaceNamingRule `json:"namespaces,omitempty"`
+
+	prefixes []string
+}
+
+// NamespaceNamingRule selects the naming profiles of the pods of some namespaces.
+type NamespaceNamingRule struct {
+	// Namespaces are globs like `team-*`, or regular expressions when enclosed in slashes like `/^team-(a|b)$/`.
+	Namespaces []string        `json:"namespaces"`
+	Profiles   []NamingProfile `json:"profiles"`
+
+	namespaces []namePattern
+	prefixes   []string
+}
+
+func (n *NamingConfig) compile() error {
+	if n.CustomPrefix != "" && !envVarPrefixPattern.MatchString(n.CustomPrefix) {
+		return fmt.Errorf("%w %q", errInvalidCustomPrefix, n.CustomPrefix)
+	}
+
+	// Without profiles, as in the configurations built by hand, the variables keep the New Relic names.
+	n.prefixes = nil
+	if len(n.Profiles) > 0 {
+		prefixes, err := n.profilePrefixes(n.Profiles)
+		if err != nil {
+			return err
+		}
+		n.prefixes = prefixes
+	}
+
+	var err error
+	for i := range n.Namespaces {
+		rule := &n.Namespaces[i]
+		if len(rule.Namespaces) == 0 {
+			return fmt.Errorf("namespace rule %d: %w", i, errEmptyNamingRule)
+		}
+		if rule.namespaces, err = compileNamePatterns(rule.Namespaces); err != nil {
+			return fmt.Errorf("namespace rule %d: %w", i, err)
+		}
+		if rule.prefixes, err = n.profilePrefixes(rule.Profiles); err != nil {
+			return fmt.Errorf("namespace rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// profilePrefixes returns the prefixes of the given profiles, without duplicates.
+func (n *NamingConfig) profilePrefixes(profiles []NamingProfile) ([]string, error) {
+	if len(profiles) == 0 {
+		return nil, errNoNamingProfile
+	}
+
+	prefixes := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		var prefix string
+		switch profile {
+		case NamingProfileNewRelic:
+			prefix = newRelicMetadataPrefix
+		case NamingProfileGeneric:
+			prefix = genericMetadataPrefix
+		case NamingProfileCustom:
+			if n.CustomPrefix == "" {
+				return nil, errMissingCustomPrefix
+			}
+			prefix = n.CustomPrefix
+		default:
+			return nil, fmt.Errorf("%w %q, expected %s, %s or %s", errUnknownNamingProfile, profile,
+				NamingProfileNewRelic, NamingProfileGeneric, NamingProfileCustom)
+		}
+		if !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// namespacePrefixes returns the prefixes of the profiles active in the given namespace. The configuration must be
+// compiled.
+func (n *NamingConfig) namespacePrefixes(namespace string) []string {
+	for _, rule := range n.Namespaces {
+		if matchesAny(rule.namespaces, namespace) {
+			return rule.prefixes
+		}
+	}
+	if len(n.prefixes) == 0 {
+		return []string{newRelicMetadataPrefix}
+	}
+	return n.prefixes
+}
+
+// renameVariables returns the variables named with the New Relic prefix once per given prefix, and the other ones
+// once as they are. When two of them end up with the same name, only the first one is kept.
+func renameVariables(vars []corev1.EnvVar, prefixes []string) []corev1.EnvVar {
+	if len(prefixes) == 1 && prefixes[0] == newRelicMetadataPrefix {
+		return vars
+	}
+
+	renamed := make([]corev1.EnvVar, 0, len(vars)*len(prefixes))
+	names := make(map[string]bool, len(vars)*len(prefixes))
+	for i, prefix := range prefixes {
+		for _, envVar := range vars {
+			suffix, prefixed := strings.CutPrefix(envVar.Name, newRelicMetadataPrefix)
+			if prefixed {
+				envVar.Name = prefix + suffix
+			} else if i > 0 {
+				continue
+			}
+			if !names[envVar.Name] {
+				names[envVar.Name] = true
+				renamed = append(renamed, envVar)
+			}
+		}
+	}
+	return renamed
+}
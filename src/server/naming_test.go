@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenameVariables(t *testing.T) {
+	t.Parallel()
+
+	vars := []corev1.EnvVar{
+		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "foobar"),
+		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_NAME", "metadata.name"),
+		createEnvVarFromString("TEAM", "checkout"),
+	}
+
+	cases := []struct {
+		name     string
+		prefixes []string
+		expected []string
+	}{
+		{
+			name:     "new relic",
+			prefixes: []string{newRelicMetadataPrefix},
+			expected: []string{"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "NEW_RELIC_METADATA_KUBERNETES_POD_NAME", "TEAM"},
+		},
+		{
+			name:     "generic",
+			prefixes: []string{genericMetadataPrefix},
+			expected: []string{"K8S_CLUSTER_NAME", "K8S_POD_NAME", "TEAM"},
+		},
+		{
+			name:     "new relic and custom",
+			prefixes: []string{newRelicMetadataPrefix, "ACME_"},
+			expected: []string{
+				"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "NEW_RELIC_METADATA_KUBERNETES_POD_NAME", "TEAM",
+				"ACME_CLUSTER_NAME", "ACME_POD_NAME",
+			},
+		},
+		{
+			name:     "custom prefix clashing with another variable",
+			prefixes: []string{genericMetadataPrefix, "TEAM"},
+			expected: []string{"K8S_CLUSTER_NAME", "K8S_POD_NAME", "TEAM", "TEAMCLUSTER_NAME", "TEAMPOD_NAME"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var names []string
+			for _, envVar := range renameVariables(vars, c.prefixes) {
+				names = append(names, envVar.Name)
+			}
+			assert.Equal(t, c.expected, names)
+		})
+	}
+}
+
+func TestNamingConfig_NamespacePrefixes(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+naming:
+  profiles: [newrelic, generic, newrelic]
+  customPrefix: ACME_K8S_
+  namespaces:
+    - namespaces: [legacy]
+      profiles: [newrelic]
+    - namespaces: ["team-*", /^platform$/]
+      profiles: [custom, generic]
+`), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{newRelicMetadataPrefix, genericMetadataPrefix}, config.Naming.namespacePrefixes("default"))
+	assert.Equal(t, []string{newRelicMetadataPrefix}, config.Naming.namespacePrefixes("legacy"))
+	assert.Equal(t, []string{"ACME_K8S_", genericMetadataPrefix}, config.Naming.namespacePrefixes("team-a"))
+	assert.Equal(t, []string{"ACME_K8S_", genericMetadataPrefix}, config.Naming.namespacePrefixes("platform"))
+
+	defaults, err := ParseInjectionConfig([]byte(``), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{newRelicMetadataPrefix}, defaults.Naming.namespacePrefixes("default"))
+}
+
+func TestUpdateContainer_NamingProfiles(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+openTelemetry: true
+naming:
+  profiles: [generic]
+variables:
+  - name: NEW_RELIC_METADATA_KUBERNETES_POD_NAME
+    fieldRef: {fieldPath: metadata.name}
+`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{ClusterName: "foobar", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	m := whsvr.newPodMutation(context.Background(), pod, config)
+	container := &corev1.Container{Name: "app", Env: []corev1.EnvVar{{Name: "K8S_POD_NAME", Value: "defined"}}}
+	patches := whsvr.updateContainer(m, containersField, 0, container)
+
+	// The variable already defined under the generic name is kept, and referenced by the resource attributes.
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/spec/containers/0/env/-",
+		Value: createEnvVarFromString(otelResourceAttributesVar, "k8s.pod.name=$(K8S_POD_NAME)"),
+	}}, patches)
+	assert.Equal(t, []string{"app/K8S_POD_NAME"}, m.defined)
+}
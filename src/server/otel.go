@@ -0,0 +1,76 @@
+package server
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// otelResourceAttributesVar is the variable the OpenTelemetry SDKs read the resource attributes from.
+const otelResourceAttributesVar = "OTEL_RESOURCE_ATTRIBUTES"
+
+// otelResourceAttributes are the OpenTelemetry resource attributes holding the same value as the metadata variables,
+// by order of appearance in OTEL_RESOURCE_ATTRIBUTES and keyed by the name of the variables without their prefix.
+var otelResourceAttributes = []struct {
+	variable  string
+	attribute string
+}{
+	{"CLUSTER_NAME", "k8s.cluster.name"},
+	{"NODE_NAME", "k8s.node.name"},
+	{"NAMESPACE_NAME", "k8s.namespace.name"},
+	{"DEPLOYMENT_NAME", "k8s.deployment.name"},
+	{"REPLICASET_NAME", "k8s.replicaset.name"},
+	{"STATEFULSET_NAME", "k8s.statefulset.name"},
+	{"DAEMONSET_NAME", "k8s.daemonset.name"},
+	{"JOB_NAME", "k8s.job.name"},
+	{"CRONJOB_NAME", "k8s.cronjob.name"},
+	{"POD_NAME", "k8s.pod.name"},
+	{"CONTAINER_NAME", "k8s.container.name"},
+}
+
+// otelResourceAttributesEnvVar returns the OTEL_RESOURCE_ATTRIBUTES variable for the metadata variables injected in a
+// container under the given prefixes, or false when none of them has a resource attribute. The attributes reference
+// the variables with the $(VAR) syntax, which Kubernetes expands when starting the container, so the downward API
+// values are available.
+func otelResourceAttributesEnvVar(vars []corev1.EnvVar, prefixes []string) (corev1.EnvVar, bool) {
+	injected := make(map[string]bool, len(vars))
+	for _, envVar := range vars {
+		injected[envVar.Name] = true
+	}
+
+	attributes := make([]string, 0, len(otelResourceAttributes))
+	for _, mapping := range otelResourceAttributes {
+		for _, prefix := range prefixes {
+			if name := prefix + mapping.variable; injected[name] {
+				attributes = append(attributes, mapping.attribute+"=$("+name+")")
+				break
+			}
+		}
+	}
+	if len(attributes) == 0 {
+		return corev1.EnvVar{}, false
+	}
+	return createEnvVarFromString(otelResourceAttributesVar, strings.Join(attributes, ",")), true
+}
+
+// mergeOTELResourceAttributes returns the injected attributes followed by the ones already defined in the container,
+// dropping the injected ones the container already defines so that its values are kept.
+func mergeOTELResourceAttributes(injected, existing string) string {
+	defined := map[string]bool{}
+	for _, attribute := range strings.Split(existing, ",") {
+		key, _, _ := strings.Cut(attribute, "=")
+		defined[strings.TrimSpace(key)] = true
+	}
+
+	var merged []string
+	for _, attribute := range strings.Split(injected, ",") {
+		key, _, _ := strings.Cut(attribute, "=")
+		if !defined[key] {
+			merged = append(merged, attribute)
+		}
+	}
+	if strings.TrimSpace(existing) != "" {
+		merged = append(merged, existing)
+	}
+	return strings.Join(merged, ",")
+}
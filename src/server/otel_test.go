@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeOTELResourceAttributes(t *testing.T) {
+	t.Parallel()
+
+	injected := "k8s.cluster.name=$(A),k8s.pod.name=$(B)"
+	cases := []struct {
+		name     string
+		existing string
+		expected string
+	}{
+		{name: "empty", existing: "", expected: injected},
+		{name: "other attributes", existing: "service.name=checkout", expected: injected + ",service.name=checkout"},
+		{
+			name:     "attributes already defined are kept",
+			existing: "service.name=checkout, k8s.cluster.name=production",
+			expected: "k8s.pod.name=$(B),service.name=checkout, k8s.cluster.name=production",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.expected, mergeOTELResourceAttributes(injected, c.existing))
+		})
+	}
+}
+
+func TestUpdateContainer_OpenTelemetry(t *testing.T) {
+	t.Parallel()
+
+	const attributes = "k8s.cluster.name=$(NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME)," +
+		"k8s.node.name=$(NEW_RELIC_METADATA_KUBERNETES_NODE_NAME)," +
+		"k8s.namespace.name=$(NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME)," +
+		"k8s.pod.name=$(NEW_RELIC_METADATA_KUBERNETES_POD_NAME)," +
+		"k8s.container.name=$(NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME)"
+
+	config, err := ParseInjectionConfig([]byte("openTelemetry: true\nconflictPolicy: fail"), nil)
+	require.NoError(t, err)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	valueFrom := &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "attributes"}}
+
+	cases := []struct {
+		name      string
+		env       []corev1.EnvVar
+		envFrom   bool
+		expected  []patchOperation
+		conflicts []string
+	}{
+		{
+			name:     "not defined",
+			expected: []patchOperation{{Op: "add", Path: "/spec/containers/0/env/-", Value: createEnvVarFromString(otelResourceAttributesVar, attributes)}},
+		},
+		{
+			name: "merged with the attributes defined",
+			env: []corev1.EnvVar{
+				{Name: otelResourceAttributesVar, Value: "service.name=checkout,k8s.cluster.name=production"},
+				{Name: "EXISTING_VAR", Value: "value"},
+			},
+			expected: []patchOperation{
+				{Op: "remove", Path: "/spec/containers/0/env/0"},
+				{Op: "add", Path: "/spec/containers/0/env/-", Value: createEnvVarFromString(otelResourceAttributesVar,
+					"k8s.node.name=$(NEW_RELIC_METADATA_KUBERNETES_NODE_NAME),"+
+						"k8s.namespace.name=$(NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME),"+
+						"k8s.pod.name=$(NEW_RELIC_METADATA_KUBERNETES_POD_NAME),"+
+						"k8s.container.name=$(NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME),"+
+						"service.name=checkout,k8s.cluster.name=production")},
+			},
+		},
+		{
+			name:     "referencing the variable of envFrom",
+			envFrom:  true,
+			expected: []patchOperation{{Op: "add", Path: "/spec/containers/0/env/-", Value: createEnvVarFromString(otelResourceAttributesVar, attributes+",$(OTEL_RESOURCE_ATTRIBUTES)")}},
+		},
+		{
+			name:      "defined from another source",
+			env:       []corev1.EnvVar{{Name: otelResourceAttributesVar, ValueFrom: valueFrom}},
+			conflicts: []string{"app/" + otelResourceAttributesVar},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			whsvr := &Webhook{ClusterName: "foobar", Logger: zap.NewNop().Sugar()}
+			m := whsvr.newPodMutation(context.Background(), pod, config)
+			if c.envFrom {
+				m.envFromVariables["app"] = map[string]bool{otelResourceAttributesVar: true}
+			}
+			container := &corev1.Container{Name: "app", Env: c.env}
+			patches := whsvr.updateContainer(m, containersField, 0, container)
+
+			var otelPatches []patchOperation
+			for _, patch := range patches {
+				if envVar, ok := patch.Value.(corev1.EnvVar); (ok && envVar.Name == otelResourceAttributesVar) || patch.Op == "remove" {
+					otelPatches = append(otelPatches, patch)
+				}
+			}
+			assert.Equal(t, c.expected, otelPatches)
+			assert.Equal(t, c.conflicts, m.conflicts)
+		})
+	}
+}
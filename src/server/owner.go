@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	deploymentKind  = "Deployment"
+	statefulSetKind = "StatefulSet"
+	daemonSetKind   = "DaemonSet"
+	jobKind         = "Job"
+	cronJobKind     = "CronJob"
+)
+
+// workloadOwners holds the names of the workloads owning a pod. A name is empty when the pod is not owned,
+// directly or through a ReplicaSet or Job, by a workload of that kind.
+type workloadOwners struct {
+	Deployment  string
+	ReplicaSet  string
+	StatefulSet string
+	DaemonSet   string
+	Job         string
+	CronJob     string
+}
+
+// OwnerResolver looks up the controller of the intermediate owners of a pod (ReplicaSets and Jobs) against the
+// Kubernetes API, so the top-level Deployment or CronJob can be known without guessing it from names.
+// Successful lookups are cached to avoid an API call per admission request.
+type OwnerResolver struct {
+	client kubernetes.Interface
+	cache  *ttlCache[string, *metav1.OwnerReference]
+}
+
+// NewOwnerResolver returns an OwnerResolver using the given client and caching the lookups for the given TTL.
+func NewOwnerResolver(client kubernetes.Interface, cacheTTL time.Duration) *OwnerResolver {
+	return &OwnerResolver{
+		client: client,
+		cache:  newTTLCache[string, *metav1.OwnerReference](cacheTTL),
+	}
+}
+
+// controllerOf returns the controller owner reference of the given ReplicaSet or Job, or nil if it has none.
+func (r *OwnerResolver) controllerOf(ctx context.Context, namespace string, owner *metav1.OwnerReference) (*metav1.OwnerReference, error) {
+	key := owner.Kind + "/" + namespace + "/" + owner.Name
+	if controller, ok := r.cache.get(key); ok {
+		return controller, nil
+	}
+
+	var objectMeta metav1.ObjectMeta
+	switch owner.Kind {
+	case replicaSetKind:
+		rs, err := r.client.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting replicaset %s/%s: %w", namespace, owner.Name, err)
+		}
+		objectMeta = rs.ObjectMeta
+	case jobKind:
+		job, err := r.client.BatchV1().Jobs(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting job %s/%s: %w", namespace, owner.Name, err)
+		}
+		objectMeta = job.ObjectMeta
+	default:
+		return nil, nil
+	}
+
+	var controller *metav1.OwnerReference
+	if ref := metav1.GetControllerOfNoCopy(&objectMeta); ref != nil {
+		controller = ref.DeepCopy()
+	}
+	if !isDryRun(ctx) {
+		r.cache.set(key, controller)
+	}
+	return controller, nil
+}
+
+// podOwner returns the owner reference of the pod that is used to find its workload: its controller, or its only
+// owner when none of them is flagged as controller.
+func podOwner(pod *corev1.Pod) *metav1.OwnerReference {
+	if controller := metav1.GetControllerOfNoCopy(pod); controller != nil {
+		return controller
+	}
+	if len(pod.OwnerReferences) == 1 {
+		return &pod.OwnerReferences[0]
+	}
+	return nil
+}
+
+// unsupportedOwnerKind returns the kind of the owner of the pod when it is not a workload whose name can be injected,
+// or an empty string.
+func unsupportedOwnerKind(pod *corev1.Pod) string {
+	owner := podOwner(pod)
+	if owner == nil {
+		return ""
+	}
+	switch owner.Kind {
+	case replicaSetKind, jobKind, statefulSetKind, daemonSetKind:
+		return ""
+	}
+	return owner.Kind
+}
+
+// deploymentFromGenerateName guesses the name of the deployment from the naming convention of its pods
+// (<deployment>-<pod-template-hash>-<suffix>). This can give a false positive if the user uses ReplicaSets directly.
+func deploymentFromGenerateName(pod *corev1.Pod) string {
+	podParts := strings.Split(pod.GenerateName, "-")
+	if len(podParts) >= 3 {
+		return strings.Join(podParts[:len(podParts)-2], "-")
+	}
+	return ""
+}
+
+// resolveOwners returns the workloads owning the pod. When the OwnerResolver is not configured or the lookup
+// fails, the Deployment is guessed from the pod name and the CronJob is left unknown.
+func (whsvr *Webhook) resolveOwners(ctx context.Context, pod *corev1.Pod) workloadOwners {
+	var owners workloadOwners
+
+	owner := podOwner(pod)
+	if owner == nil || owner.Name == "" {
+		return owners
+	}
+
+	switch owner.Kind {
+	case replicaSetKind:
+		owners.ReplicaSet = owner.Name
+		controller, err := whsvr.lookupController(ctx, pod.Namespace, owner)
+		if err != nil {
+			owners.Deployment = deploymentFromGenerateName(pod)
+			break
+		}
+		if controller != nil && controller.Kind == deploymentKind {
+			owners.Deployment = controller.Name
+		}
+	case jobKind:
+		owners.Job = owner.Name
+		controller, err := whsvr.lookupController(ctx, pod.Namespace, owner)
+		if err == nil && controller != nil && controller.Kind == cronJobKind {
+			owners.CronJob = controller.Name
+		}
+	case statefulSetKind:
+		owners.StatefulSet = owner.Name
+	case daemonSetKind:
+		owners.DaemonSet = owner.Name
+	}
+
+	return owners
+}
+
+// errOwnerLookupDisabled is returned by lookupController when no OwnerResolver is configured.
+var errOwnerLookupDisabled = errors.New("owner lookup disabled")
+
+func (whsvr *Webhook) lookupController(ctx context.Context, namespace string, owner *metav1.OwnerReference) (*metav1.OwnerReference, error) {
+	if whsvr.Owners == nil {
+		return nil, errOwnerLookupDisabled
+	}
+
+	controller, err := whsvr.Owners.controllerOf(ctx, namespace, owner)
+	if err != nil {
+		whsvr.Logger.Warnw("could not resolve owner, falling back to name heuristics", "kind", owner.Kind, "name", owner.Name, "namespace", namespace, "err", err)
+		return nil, err
+	}
+	return controller, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &isController}}
+}
+
+func TestResolveOwners(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name: "web-5d8f7b6c9", Namespace: "default", OwnerReferences: controllerRef(deploymentKind, "web"),
+		}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "bare-rs", Namespace: "default"}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Name: "backup-29000000", Namespace: "default", OwnerReferences: controllerRef(cronJobKind, "backup"),
+		}},
+	)
+
+	cases := []struct {
+		name     string
+		pod      *corev1.Pod
+		resolver *OwnerResolver
+		expected workloadOwners
+	}{
+		{
+			name: "deployment resolved through its replicaset",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", GenerateName: "web-5d8f7b6c9-", OwnerReferences: controllerRef(replicaSetKind, "web-5d8f7b6c9"),
+			}},
+			resolver: NewOwnerResolver(client, time.Minute),
+			expected: workloadOwners{Deployment: "web", ReplicaSet: "web-5d8f7b6c9"},
+		},
+		{
+			name: "bare replicaset has no deployment",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", GenerateName: "bare-rs-", OwnerReferences: controllerRef(replicaSetKind, "bare-rs"),
+			}},
+			resolver: NewOwnerResolver(client, time.Minute),
+			expected: workloadOwners{ReplicaSet: "bare-rs"},
+		},
+		{
+			name: "deployment guessed from the pod name without resolver",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", GenerateName: "web-5d8f7b6c9-", OwnerReferences: controllerRef(replicaSetKind, "web-5d8f7b6c9"),
+			}},
+			expected: workloadOwners{Deployment: "web", ReplicaSet: "web-5d8f7b6c9"},
+		},
+		{
+			name: "deployment guessed from the pod name when the lookup fails",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", GenerateName: "api-7c9d8-", OwnerReferences: controllerRef(replicaSetKind, "api-7c9d8"),
+			}},
+			resolver: NewOwnerResolver(client, time.Minute),
+			expected: workloadOwners{Deployment: "api", ReplicaSet: "api-7c9d8"},
+		},
+		{
+			name: "cronjob resolved through its job",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", OwnerReferences: controllerRef(jobKind, "backup-29000000"),
+			}},
+			resolver: NewOwnerResolver(client, time.Minute),
+			expected: workloadOwners{Job: "backup-29000000", CronJob: "backup"},
+		},
+		{
+			name: "job without resolver",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", OwnerReferences: controllerRef(jobKind, "backup-29000000"),
+			}},
+			expected: workloadOwners{Job: "backup-29000000"},
+		},
+		{
+			name: "statefulset",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", OwnerReferences: controllerRef(statefulSetKind, "db"),
+			}},
+			expected: workloadOwners{StatefulSet: "db"},
+		},
+		{
+			name: "daemonset",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default", OwnerReferences: controllerRef(daemonSetKind, "agent"),
+			}},
+			expected: workloadOwners{DaemonSet: "agent"},
+		},
+		{
+			name:     "no owner",
+			pod:      &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "standalone"}},
+			expected: workloadOwners{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			whsvr := &Webhook{Logger: zap.NewNop().Sugar(), Owners: c.resolver}
+			assert.Equal(t, c.expected, whsvr.resolveOwners(context.Background(), c.pod))
+		})
+	}
+}
+
+func TestOwnerResolver_CachesLookups(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name: "web-5d8f7b6c9", Namespace: "default", OwnerReferences: controllerRef(deploymentKind, "web"),
+	}})
+	gets := 0
+	client.PrependReactor("get", "replicasets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	whsvr := &Webhook{Logger: zap.NewNop().Sugar(), Owners: NewOwnerResolver(client, time.Minute)}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", OwnerReferences: controllerRef(replicaSetKind, "web-5d8f7b6c9"),
+	}}
+
+	for range 3 {
+		assert.Equal(t, "web", whsvr.resolveOwners(context.Background(), pod).Deployment)
+	}
+	assert.Equal(t, 1, gets)
+}
@@ -1,9 +1,15 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 // TLSReadyReadinessProbe defines a readiness check for a Webhook struct based on the presence of its TLS certificate and key.
 // It requires the whole webhook as parameter to be able to RLock on the certificate for the presence confirmation.
+// The webhook is not ready either when the certificate is expired or not yet valid, or when the client certificates
+// are verified but the CA bundle is not loaded. The reason of the last rejected
+// certificate reload, if any, is added to the response.
 func TLSReadyReadinessProbe(webhook *Webhook) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		webhook.RLock()
@@ -11,6 +17,25 @@ func TLSReadyReadinessProbe(webhook *Webhook) http.HandlerFunc {
 
 		if webhook.Cert == nil {
 			response := "Certificate not present"
+			if webhook.certReloadErr != nil {
+				response += ": " + webhook.certReloadErr.Error()
+			}
+			w.WriteHeader(503)
+			if _, err := w.Write([]byte(response)); err != nil {
+				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+			}
+			return
+		}
+
+		leaf, err := certificateLeaf(webhook.Cert)
+		if err == nil && leaf != nil {
+			err = checkCertificateValidity(leaf, time.Now())
+		}
+		if err == nil && webhook.ClientAuth != nil {
+			err = webhook.ClientAuth.ready()
+		}
+		if err != nil {
+			response := err.Error()
 			w.WriteHeader(503)
 			if _, err := w.Write([]byte(response)); err != nil {
 				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
@@ -19,6 +44,9 @@ func TLSReadyReadinessProbe(webhook *Webhook) http.HandlerFunc {
 		}
 
 		okResponse := "OK"
+		if webhook.certReloadErr != nil {
+			okResponse += ", keeping the previous certificate: " + webhook.certReloadErr.Error()
+		}
 		if _, err := w.Write([]byte(okResponse)); err != nil {
 			webhook.Logger.Errorw("can't write response", "err", err, "response", okResponse)
 		}
@@ -3,9 +3,11 @@ package server
 import (
 	"crypto/tls"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -13,10 +15,12 @@ import (
 )
 
 func TestTLSReadyReadinessProbe(t *testing.T) {
+	now := time.Now()
 	cases := []struct {
 		desc         string
 		certificate  *tls.Certificate
 		responseCode int
+		body         string
 	}{
 		{
 			desc:         "certificate not present (bad health)",
@@ -28,6 +32,23 @@ func TestTLSReadyReadinessProbe(t *testing.T) {
 			certificate:  &tls.Certificate{},
 			responseCode: 200,
 		},
+		{
+			desc:         "valid certificate (good health)",
+			certificate:  newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour)),
+			responseCode: 200,
+		},
+		{
+			desc:         "expired certificate (bad health)",
+			certificate:  newTestCertificate(t, now.Add(-2*time.Hour), now.Add(-time.Hour)),
+			responseCode: 503,
+			body:         "certificate expired on ",
+		},
+		{
+			desc:         "certificate not yet valid (bad health)",
+			certificate:  newTestCertificate(t, now.Add(time.Hour), now.Add(2*time.Hour)),
+			responseCode: 503,
+			body:         "certificate not yet valid until ",
+		},
 	}
 
 	webhook := Webhook{}
@@ -42,6 +63,10 @@ func TestTLSReadyReadinessProbe(t *testing.T) {
 
 			assert.NoError(t, err)
 			assert.Equal(t, c.responseCode, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(body), c.body)
+			_ = resp.Body.Close()
 		})
 	}
 }
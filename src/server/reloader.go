@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const (
+	fileReloadDebounce     = 500 * time.Millisecond
+	fileWatchRetryInterval = time.Second
+)
+
+// FileReloader calls Reload when any of its files change. It watches the directories of the files rather than the
+// files, since Kubernetes updates the ConfigMap and Secret volumes by creating a new directory and flipping the ..data
+// symlink to it. A watched directory being removed is watched again as soon as it is back, and the files are also
+// polled in case events are missed or the watcher can't be created.
+type FileReloader struct {
+	// Name describes the files in the logs, like "certificate".
+	Name string
+	// Files are the files to watch.
+	Files []string
+	// Reload is called once the files changed, after a short debounce.
+	Reload func()
+	// PollInterval is how often the files are checked for changes regardless of the events. Zero disables polling.
+	PollInterval time.Duration
+	Logger       *zap.SugaredLogger
+
+	debounce   time.Duration
+	newWatcher func() (*fsnotify.Watcher, error)
+	// started, if set, is called once the files are watched or polled, so the tests can change them.
+	started func()
+	dirs    map[string]bool
+	states  map[string]fileState
+}
+
+// fileState identifies the content of a watched file, to detect changes when polling.
+type fileState struct {
+	target  string
+	modTime int64
+	size    int64
+}
+
+// NewFileReloader returns a FileReloader calling reload when the given files change.
+func NewFileReloader(name string, files []string, pollInterval time.Duration, reload func(), logger *zap.SugaredLogger) *FileReloader {
+	return &FileReloader{
+		Name:         name,
+		Files:        files,
+		Reload:       reload,
+		PollInterval: pollInterval,
+		Logger:       logger,
+		debounce:     fileReloadDebounce,
+		newWatcher:   fsnotify.NewWatcher,
+	}
+}
+
+// Run watches the files until the context is done.
+func (r *FileReloader) Run(ctx context.Context) {
+	logger := r.Logger
+	r.dirs = make(map[string]bool)
+	for _, file := range r.Files {
+		r.dirs[filepath.Dir(file)] = false
+	}
+	r.states = r.fileStates()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var retry <-chan time.Time
+	watcher, err := r.newWatcher()
+	if err != nil {
+		logger.Errorw("could not create the "+r.Name+" watcher, relying on polling", "err", err, "interval", r.PollInterval)
+	} else {
+		defer func() { _ = watcher.Close() }()
+		events, errs = watcher.Events, watcher.Errors
+		if !r.watch(watcher) {
+			retry = time.After(fileWatchRetryInterval)
+		}
+	}
+
+	var poll <-chan time.Time
+	if r.PollInterval > 0 {
+		ticker := time.NewTicker(r.PollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	if r.started != nil {
+		r.started()
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+			if event.Op == fsnotify.Chmod {
+				break
+			}
+			// The watch is lost along with the directory, it is added again once the directory is back.
+			dir := filepath.Clean(event.Name)
+			if _, watched := r.dirs[dir]; watched && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+				logger.Warnw(r.Name+" directory removed, waiting for it to be back", "folder", dir)
+				r.dirs[dir] = false
+				retry = time.After(fileWatchRetryInterval)
+			}
+			debounce = time.After(r.debounce)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				break
+			}
+			// Events may have been dropped, so the files are reloaded anyway.
+			logger.Errorw(r.Name+" watcher error", "err", err)
+			debounce = time.After(r.debounce)
+		case <-retry:
+			if r.watch(watcher) {
+				debounce = time.After(r.debounce)
+			} else {
+				retry = time.After(fileWatchRetryInterval)
+			}
+		case <-poll:
+			if watcher != nil && r.watch(watcher) {
+				retry = nil
+			}
+			if states := r.fileStates(); !maps.Equal(states, r.states) {
+				logger.Debugw(r.Name + " files changed since the last check")
+				debounce = time.After(r.debounce)
+			}
+		case <-debounce:
+			r.states = r.fileStates()
+			r.Reload()
+		}
+	}
+}
+
+// watch adds the directories not watched yet to the watcher, and returns whether all of them are watched.
+func (r *FileReloader) watch(watcher *fsnotify.Watcher) bool {
+	all := true
+	for dir, watched := range r.dirs {
+		if watched {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			r.Logger.Debugw("could not watch folder", "folder", dir, "err", err)
+			all = false
+			continue
+		}
+		r.dirs[dir] = true
+	}
+	return all
+}
+
+// fileStates returns the state of the watched files, following the symlinks. Missing files have an empty state.
+func (r *FileReloader) fileStates() map[string]fileState {
+	states := make(map[string]fileState, len(r.Files))
+	for _, file := range r.Files {
+		var state fileState
+		if target, err := filepath.EvalSymlinks(file); err == nil {
+			state.target = target
+		}
+		if info, err := os.Stat(file); err == nil {
+			state.modTime, state.size = info.ModTime().UnixNano(), info.Size()
+		}
+		states[file] = state
+	}
+	return states
+}
+
+// CertReloader reloads the certificate of the webhook, and the CA bundle of its ClientAuth if any, when their files
+// change, through a FileReloader.
+type CertReloader struct {
+	Webhook *Webhook
+	// PollInterval is how often the files are checked for changes regardless of the events. Zero disables polling.
+	PollInterval time.Duration
+	// OnReload, if set, is called after each reload with its result.
+	OnReload func(err error)
+
+	debounce   time.Duration
+	newWatcher func() (*fsnotify.Watcher, error)
+	started    func()
+}
+
+// NewCertReloader returns a CertReloader for the CertFile and KeyFile of the webhook, and the CAFile of its
+// ClientAuth. The certificate is not reloaded when CertFile is empty.
+func NewCertReloader(webhook *Webhook, pollInterval time.Duration) *CertReloader {
+	return &CertReloader{
+		Webhook:      webhook,
+		PollInterval: pollInterval,
+		debounce:     fileReloadDebounce,
+		newWatcher:   fsnotify.NewWatcher,
+	}
+}
+
+// Run watches the certificate files until the context is done.
+func (r *CertReloader) Run(ctx context.Context) {
+	reloader := NewFileReloader("certificate", r.watchedFiles(), r.PollInterval, r.reload, r.Webhook.Logger)
+	reloader.debounce, reloader.newWatcher, reloader.started = r.debounce, r.newWatcher, r.started
+	reloader.Run(ctx)
+}
+
+func (r *CertReloader) reload() {
+	var certErr, caErr error
+	if r.Webhook.CertFile != "" {
+		if certErr = r.Webhook.ReloadCert(); certErr != nil {
+			r.Webhook.Logger.Errorw("reload cert error, keeping the previous one", "err", certErr)
+		} else {
+			r.Webhook.Logger.Info("cert/key pair reloaded!")
+		}
+	}
+	if r.Webhook.ClientAuth != nil {
+		if caErr = r.Webhook.ClientAuth.Reload(); caErr != nil {
+			r.Webhook.Logger.Errorw("reload client CA error, keeping the previous one", "err", caErr)
+		} else {
+			r.Webhook.Logger.Info("client CA bundle reloaded!")
+		}
+	}
+
+	if r.OnReload != nil {
+		r.OnReload(errors.Join(certErr, caErr))
+	}
+}
+
+// watchedFiles returns the files to reload.
+func (r *CertReloader) watchedFiles() []string {
+	var files []string
+	if r.Webhook.CertFile != "" {
+		files = append(files, r.Webhook.CertFile, r.Webhook.KeyFile)
+	}
+	if r.Webhook.ClientAuth != nil {
+		files = append(files, r.Webhook.ClientAuth.CAFile)
+	}
+	return files
+}
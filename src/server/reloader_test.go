@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeTestKeyPair writes a new key pair in the given files and returns its certificate.
+func writeTestKeyPair(t *testing.T, certFile, keyFile string) []byte {
+	t.Helper()
+	pair, err := generateSelfSignedPair(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "webhook.newrelic.svc"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pair.certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pair.keyPEM, 0o600))
+	return pair.cert.Raw
+}
+
+// startTestReloader runs a reloader until the test ends, waiting for it to return before the temporary directories
+// are removed. It returns once the reloader watches or polls its files, through its started hook.
+func startTestReloader(t *testing.T, run func(context.Context), started *func()) {
+	t.Helper()
+	ready := make(chan struct{})
+	*started = func() { close(ready) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reloader did not start")
+	}
+}
+
+// startTestCertReloader loads the certificate of the webhook and runs a CertReloader until the test ends.
+func startTestCertReloader(t *testing.T, webhook *Webhook, configure func(*CertReloader)) {
+	t.Helper()
+	webhook.Logger = zap.NewNop().Sugar()
+	require.NoError(t, webhook.ReloadCert())
+
+	reloader := NewCertReloader(webhook, 0)
+	reloader.debounce = 10 * time.Millisecond
+	if configure != nil {
+		configure(reloader)
+	}
+	startTestReloader(t, reloader.Run, &reloader.started)
+}
+
+// waitReload returns the result of the next reload, failing the test if there is none before the deadline.
+func waitReload(t *testing.T, reloads <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-reloads:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the files were not reloaded")
+		return nil
+	}
+}
+
+func assertCertServed(t *testing.T, webhook *Webhook, raw []byte) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		cert, err := webhook.GetCert(&tls.ClientHelloInfo{})
+		return err == nil && cert != nil && string(cert.Certificate[0]) == string(raw)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCertReloader_FilesRewritten(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	webhook := &Webhook{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile)
+	startTestCertReloader(t, webhook, nil)
+
+	assertCertServed(t, webhook, writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile))
+}
+
+func TestCertReloader_SecretVolumeSwap(t *testing.T) {
+	t.Parallel()
+
+	// Mimic the layout of the Secret volumes: the files are symlinks to ..data, itself a symlink to a timestamped
+	// directory holding the actual files.
+	dir := t.TempDir()
+	writeVersion := func(t *testing.T, version string) []byte {
+		t.Helper()
+		versionDir := filepath.Join(dir, version)
+		require.NoError(t, os.Mkdir(versionDir, 0o700))
+		return writeTestKeyPair(t, filepath.Join(versionDir, "tls.crt"), filepath.Join(versionDir, "tls.key"))
+	}
+	writeVersion(t, "..2026_01_01_00_00_00.1")
+	require.NoError(t, os.Symlink("..2026_01_01_00_00_00.1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "tls.crt"), filepath.Join(dir, "tls.crt")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "tls.key"), filepath.Join(dir, "tls.key")))
+
+	webhook := &Webhook{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	startTestCertReloader(t, webhook, nil)
+
+	raw := writeVersion(t, "..2026_01_02_00_00_00.2")
+	require.NoError(t, os.Symlink("..2026_01_02_00_00_00.2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "..2026_01_01_00_00_00.1")))
+
+	assertCertServed(t, webhook, raw)
+}
+
+func TestCertReloader_DirectoryRemoved(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "certs")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	webhook := &Webhook{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	previous := writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile)
+	reloads := make(chan error, 10)
+	startTestCertReloader(t, webhook, func(r *CertReloader) {
+		r.OnReload = func(err error) { reloads <- err }
+	})
+
+	require.NoError(t, os.RemoveAll(dir))
+	// The previous certificate is kept while the files are missing.
+	assert.Error(t, waitReload(t, reloads))
+	assertCertServed(t, webhook, previous)
+
+	require.NoError(t, os.Mkdir(dir, 0o700))
+	assertCertServed(t, webhook, writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile))
+
+	// The directory is watched again.
+	assertCertServed(t, webhook, writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile))
+}
+
+func TestCertReloader_KeyInAnotherDirectory(t *testing.T) {
+	t.Parallel()
+
+	certDir, keyDir := t.TempDir(), t.TempDir()
+	webhook := &Webhook{CertFile: filepath.Join(certDir, "tls.crt"), KeyFile: filepath.Join(keyDir, "tls.key")}
+	first := writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile)
+	reloads := make(chan error, 10)
+	startTestCertReloader(t, webhook, func(r *CertReloader) {
+		r.OnReload = func(err error) { reloads <- err }
+	})
+
+	// A certificate not matching the key yet is rejected, the pair is loaded once the key is also written.
+	tmpDir := t.TempDir()
+	raw := writeTestKeyPair(t, filepath.Join(tmpDir, "tls.crt"), filepath.Join(tmpDir, "tls.key"))
+	certPEM, err := os.ReadFile(filepath.Join(tmpDir, "tls.crt"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(webhook.CertFile, certPEM, 0o600))
+	assert.Error(t, waitReload(t, reloads))
+	assertCertServed(t, webhook, first)
+
+	keyPEM, err := os.ReadFile(filepath.Join(tmpDir, "tls.key"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(webhook.KeyFile, keyPEM, 0o600))
+	assertCertServed(t, webhook, raw)
+}
+
+func TestCertReloader_Polling(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	webhook := &Webhook{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile)
+	reloads := make(chan error, 10)
+	startTestCertReloader(t, webhook, func(r *CertReloader) {
+		r.PollInterval = 20 * time.Millisecond
+		r.newWatcher = func() (*fsnotify.Watcher, error) { return nil, errors.New("too many open files") }
+		r.OnReload = func(err error) { reloads <- err }
+	})
+
+	assertCertServed(t, webhook, writeTestKeyPair(t, webhook.CertFile, webhook.KeyFile))
+	assert.NoError(t, waitReload(t, reloads))
+}
+
+func TestCertReloader_ClientCA(t *testing.T) {
+	t.Parallel()
+
+	// Without CertFile, as with self-signed certificates, only the client CA bundle is reloaded.
+	_, issue := newTestClientPKI(t)
+	otherCA, issueOther := newTestClientPKI(t)
+	caFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0o600))
+	auth, err := NewClientAuth(caFile, nil)
+	require.NoError(t, err)
+	webhook := &Webhook{ClientAuth: auth, Logger: zap.NewNop().Sugar()}
+
+	reloader := NewCertReloader(webhook, 0)
+	reloader.debounce = 10 * time.Millisecond
+	startTestReloader(t, reloader.Run, &reloader.started)
+
+	require.NoError(t, os.WriteFile(caFile, otherCA.certPEM, 0o600))
+	client, other := issue("kube-apiserver"), issueOther("kube-apiserver")
+	assert.Eventually(t, func() bool {
+		return auth.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{other.Leaf}}) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Error(t, auth.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.Leaf}}))
+	assert.Nil(t, webhook.Cert)
+}
+
+func TestFileReloader_InjectionConfigMapSwap(t *testing.T) {
+	t.Parallel()
+
+	// Mimic the layout of the ConfigMap volumes, as for the Secret ones.
+	dir := t.TempDir()
+	writeVersion := func(t *testing.T, version, clusterName string) {
+		t.Helper()
+		versionDir := filepath.Join(dir, version)
+		require.NoError(t, os.Mkdir(versionDir, 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(versionDir, "config.yaml"), []byte("clusterName: "+clusterName), 0o600))
+	}
+	writeVersion(t, "..2026_01_01_00_00_00.1", "first")
+	require.NoError(t, os.Symlink("..2026_01_01_00_00_00.1", filepath.Join(dir, "..data")))
+	require.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+
+	file := filepath.Join(dir, "config.yaml")
+	webhook := &Webhook{Logger: zap.NewNop().Sugar()}
+	reloader := NewFileReloader("injection config", []string{file}, 0, func() {
+		if config, err := LoadInjectionConfig(file, nil); err == nil {
+			webhook.SetConfig(config)
+		}
+	}, webhook.Logger)
+	reloader.debounce = 10 * time.Millisecond
+	startTestReloader(t, reloader.Run, &reloader.started)
+
+	writeVersion(t, "..2026_01_02_00_00_00.2", "second")
+	require.NoError(t, os.Symlink("..2026_01_02_00_00_00.2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "..2026_01_01_00_00_00.1")))
+
+	assert.Eventually(t, func() bool {
+		return webhook.injectionConfig().ClusterName == "second"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestFileReloader_Polling(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("clusterName: first"), 0o600))
+	reloads := make(chan error, 10)
+	reloader := NewFileReloader("injection config", []string{file}, 20*time.Millisecond, func() { reloads <- nil },
+		zap.NewNop().Sugar())
+	reloader.debounce = 10 * time.Millisecond
+	reloader.newWatcher = func() (*fsnotify.Watcher, error) { return nil, errors.New("too many open files") }
+	startTestReloader(t, reloader.Run, &reloader.started)
+
+	require.NoError(t, os.WriteFile(file, []byte("clusterName: second"), 0o600))
+	assert.NoError(t, waitReload(t, reloads))
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var (
+	errUnknownContainerResource = errors.New("unknown container resource")
+	errInvalidResourceDivisor   = errors.New("invalid divisor")
+)
+
+// containerResourceVariables are the variables of the container resources, by order of injection.
+var containerResourceVariables = []struct {
+	resource string
+	name     string
+}{
+	{"requests.cpu", newRelicMetadataPrefix + "CONTAINER_CPU_REQUEST"},
+	{"limits.cpu", newRelicMetadataPrefix + "CONTAINER_CPU_LIMIT"},
+	{"requests.memory", newRelicMetadataPrefix + "CONTAINER_MEMORY_REQUEST"},
+	{"limits.memory", newRelicMetadataPrefix + "CONTAINER_MEMORY_LIMIT"},
+}
+
+// Divisors accepted by the API server for the resourceFieldRef of the CPU and the memory.
+var (
+	cpuDivisors    = []string{"1m", "1"}
+	memoryDivisors = []string{"1", "1k", "1M", "1G", "1T", "1P", "1E", "1Ki", "1Mi", "1Gi", "1Ti", "1Pi", "1Ei"}
+)
+
+// containerResourceVariableNames validates the given resources and their divisors, and returns the names of their
+// variables.
+func containerResourceVariableNames(resources map[string]resource.Quantity) ([]string, error) {
+	for _, name := range slices.Sorted(maps.Keys(resources)) {
+		var allowed []string
+		switch name {
+		case "requests.cpu", "limits.cpu":
+			allowed = cpuDivisors
+		case "requests.memory", "limits.memory":
+			allowed = memoryDivisors
+		default:
+			return nil, fmt.Errorf("%w %q, expected requests.cpu, limits.cpu, requests.memory or limits.memory",
+				errUnknownContainerResource, name)
+		}
+
+		divisor := resources[name]
+		if divisor.IsZero() {
+			continue
+		}
+		if !slices.ContainsFunc(allowed, func(d string) bool { return divisor.Cmp(resource.MustParse(d)) == 0 }) {
+			return nil, fmt.Errorf("%w %s for %s, expected one of %v", errInvalidResourceDivisor, divisor.String(), name, allowed)
+		}
+	}
+
+	var names []string
+	for _, variable := range containerResourceVariables {
+		if _, ok := resources[variable.resource]; ok {
+			names = append(names, variable.name)
+		}
+	}
+	return names, nil
+}
+
+// containerResourceEnvVars returns the variables of the given resources of the container. A resourceFieldRef must
+// name the container it refers to, so the variables are specific to each container. A zero divisor is the default
+// one of the API server, 1.
+func containerResourceEnvVars(container *corev1.Container, resources map[string]resource.Quantity) []corev1.EnvVar {
+	var vars []corev1.EnvVar
+	for _, variable := range containerResourceVariables {
+		divisor, ok := resources[variable.resource]
+		if !ok {
+			continue
+		}
+		vars = append(vars, corev1.EnvVar{
+			Name: variable.name,
+			ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+				ContainerName: container.Name,
+				Resource:      variable.resource,
+				Divisor:       divisor,
+			}},
+		})
+	}
+	return vars
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestContainerResourceVariableNames(t *testing.T) {
+	t.Parallel()
+
+	names, err := containerResourceVariableNames(map[string]resource.Quantity{
+		"limits.memory": resource.MustParse("1Mi"),
+		"requests.cpu":  resource.MustParse("1m"),
+		"limits.cpu":    {},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_CPU_REQUEST",
+		"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_CPU_LIMIT",
+		"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_MEMORY_LIMIT",
+	}, names)
+
+	_, err = containerResourceVariableNames(map[string]resource.Quantity{"limits.ephemeral-storage": resource.MustParse("1")})
+	assert.ErrorIs(t, err, errUnknownContainerResource)
+
+	_, err = containerResourceVariableNames(map[string]resource.Quantity{"limits.cpu": resource.MustParse("1Mi")})
+	assert.ErrorIs(t, err, errInvalidResourceDivisor)
+}
+
+func TestUpdateContainer_ContainerResources(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+naming:
+  profiles: [newrelic, generic]
+variables: []
+containerResources:
+  limits.cpu: 1m
+  limits.memory: null
+`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{ClusterName: "foobar", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	m := whsvr.newPodMutation(context.Background(), pod, config)
+
+	resourceVar := func(name, resourceName string, divisor resource.Quantity) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{
+			ContainerName: "sidecar",
+			Resource:      resourceName,
+			Divisor:       divisor,
+		}}}
+	}
+	cpuLimit := resourceVar("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_CPU_LIMIT", "limits.cpu", resource.MustParse("1m"))
+	memoryLimit := resourceVar("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_MEMORY_LIMIT", "limits.memory", resource.Quantity{})
+	genericCPULimit, genericMemoryLimit := cpuLimit, memoryLimit
+	genericCPULimit.Name, genericMemoryLimit.Name = "K8S_CONTAINER_CPU_LIMIT", "K8S_CONTAINER_MEMORY_LIMIT"
+
+	// The resource field references name the mutated container.
+	patches := whsvr.updateContainer(m, containersField, 1, &corev1.Container{Name: "sidecar"})
+	assert.Equal(t, []patchOperation{
+		{Op: "add", Path: "/spec/containers/1/env", Value: []corev1.EnvVar{cpuLimit}},
+		{Op: "add", Path: "/spec/containers/1/env/-", Value: memoryLimit},
+		{Op: "add", Path: "/spec/containers/1/env/-", Value: genericCPULimit},
+		{Op: "add", Path: "/spec/containers/1/env/-", Value: genericMemoryLimit},
+	}, patches)
+
+	// Ephemeral containers have no resources.
+	assert.Empty(t, whsvr.updateContainer(m, ephemeralContainersField, 0, &corev1.Container{Name: "debugger"}))
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Keys of the Secret holding the self-signed certificates. The serving pair uses the keys of the kubernetes.io/tls
+// Secrets so the Secret can also be mounted as TLSCertFile and TLSKeyFile.
+const (
+	secretCACertKey = "ca.crt"
+	secretCAKeyKey  = "ca.key"
+	secretCertKey   = corev1.TLSCertKey
+	secretKeyKey    = corev1.TLSPrivateKeyKey
+)
+
+var (
+	errSelfSigned            = errors.New("ensuring self-signed certificates")
+	errWebhookConfigNotFound = errors.New("mutating webhook configuration not found")
+	errUnexpectedKeyType     = errors.New("unexpected key type")
+)
+
+// SelfSignedCertificates generates the CA and the serving certificate of the webhook instead of relying on files
+// provisioned by someone else. They are stored in a Secret, shared by all the replicas, and the CA is written in the
+// caBundle of the MutatingWebhookConfiguration so the API server trusts the webhook.
+type SelfSignedCertificates struct {
+	Client kubernetes.Interface
+	// Namespace and SecretName locate the Secret holding the certificates.
+	Namespace  string
+	SecretName string
+	// WebhookConfigName is the name of the MutatingWebhookConfiguration whose caBundle is patched.
+	WebhookConfigName string
+	// DNSNames are the names the serving certificate is valid for, usually the ones of the webhook service.
+	DNSNames []string
+	// CAValidity and CertValidity are how long the generated CA and serving certificate are valid.
+	CAValidity   time.Duration
+	CertValidity time.Duration
+	// RenewBefore is the remaining validity at which the certificates are generated again.
+	RenewBefore time.Duration
+
+	now func() time.Time
+}
+
+// selfSignedPair is a certificate along with its key, both parsed and PEM encoded.
+type selfSignedPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Ensure returns the serving certificate stored in the Secret, generating the CA and serving certificate when they
+// are missing, about to expire or not valid for the DNS names, and makes sure the caBundle of the
+// MutatingWebhookConfiguration trusts the CA. It returns whether new certificates were generated.
+func (s *SelfSignedCertificates) Ensure(ctx context.Context) (*tls.Certificate, bool, error) {
+	cert, generated, err := s.ensure(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", errSelfSigned, err)
+	}
+	return cert, generated, nil
+}
+
+func (s *SelfSignedCertificates) ensure(ctx context.Context) (*tls.Certificate, bool, error) {
+	secrets := s.Client.CoreV1().Secrets(s.Namespace)
+	secret, err := secrets.Get(ctx, s.SecretName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, false, fmt.Errorf("getting secret %s/%s: %w", s.Namespace, s.SecretName, err)
+	}
+	exists := err == nil
+
+	var ca, serving *selfSignedPair
+	if exists {
+		// Invalid content is not an error, the certificates are just generated again.
+		ca, _ = parseSelfSignedPair(secret.Data[secretCACertKey], secret.Data[secretCAKeyKey])
+		serving, _ = parseSelfSignedPair(secret.Data[secretCertKey], secret.Data[secretKeyKey])
+	}
+
+	var previousCA *x509.Certificate
+	generated := false
+	if !s.usable(ca, nil) {
+		if ca != nil {
+			previousCA = ca.cert
+		}
+		if ca, err = s.generateCA(); err != nil {
+			return nil, false, err
+		}
+		generated = true
+	}
+	if generated || !s.usable(serving, ca.cert) {
+		if serving, err = s.generateServing(ca); err != nil {
+			return nil, false, err
+		}
+		generated = true
+	}
+
+	if generated {
+		if !exists {
+			secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: s.SecretName, Namespace: s.Namespace}, Type: corev1.SecretTypeTLS}
+		}
+		secret.Data = map[string][]byte{
+			secretCACertKey: ca.certPEM,
+			secretCAKeyKey:  ca.keyPEM,
+			secretCertKey:   serving.certPEM,
+			secretKeyKey:    serving.keyPEM,
+		}
+		if exists {
+			_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		} else {
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		}
+		// On conflicts another replica stored its certificates first, the next call picks them up.
+		if err != nil {
+			return nil, false, fmt.Errorf("storing certificates in secret %s/%s: %w", s.Namespace, s.SecretName, err)
+		}
+	}
+
+	if err := s.patchCABundle(ctx, ca, previousCA); err != nil {
+		return nil, false, err
+	}
+
+	pair, err := tls.X509KeyPair(serving.certPEM, serving.keyPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading serving certificate: %w", err)
+	}
+	return &pair, generated, nil
+}
+
+// usable tells if the pair is valid for longer than RenewBefore. When a CA is given, the pair must also be signed by
+// it and valid for the DNS names.
+func (s *SelfSignedCertificates) usable(pair *selfSignedPair, ca *x509.Certificate) bool {
+	if pair == nil {
+		return false
+	}
+	now := s.clock()
+	if now.Before(pair.cert.NotBefore) || now.Add(s.RenewBefore).After(pair.cert.NotAfter) {
+		return false
+	}
+	if ca == nil {
+		return pair.cert.IsCA
+	}
+	if pair.cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	for _, name := range s.DNSNames {
+		if !slices.Contains(pair.cert.DNSNames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// patchCABundle makes the webhooks of the MutatingWebhookConfiguration trust the CA. The previous CA, if still
+// valid, is kept in the bundle so the replicas not reloaded yet keep being trusted.
+func (s *SelfSignedCertificates) patchCABundle(ctx context.Context, ca *selfSignedPair, previousCA *x509.Certificate) error {
+	configs := s.Client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, s.WebhookConfigName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %s", errWebhookConfigNotFound, s.WebhookConfigName)
+	}
+	if err != nil {
+		return fmt.Errorf("getting mutating webhook configuration %s: %w", s.WebhookConfigName, err)
+	}
+
+	bundle := ca.certPEM
+	if previousCA != nil && s.clock().Before(previousCA.NotAfter) {
+		bundle = append(slices.Clone(bundle), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: previousCA.Raw})...)
+	}
+
+	updated := false
+	for i := range config.Webhooks {
+		clientConfig := &config.Webhooks[i].ClientConfig
+		if previousCA == nil && bytes.Contains(clientConfig.CABundle, ca.certPEM) {
+			continue
+		}
+		clientConfig.CABundle = bundle
+		updated = true
+	}
+	if !updated {
+		return nil
+	}
+
+	if _, err := configs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating caBundle of mutating webhook configuration %s: %w", s.WebhookConfigName, err)
+	}
+	return nil
+}
+
+func (s *SelfSignedCertificates) generateCA() (*selfSignedPair, error) {
+	now := s.clock()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: s.SecretName + "-ca"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(s.CAValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	return generateSelfSignedPair(template, nil)
+}
+
+func (s *SelfSignedCertificates) generateServing(ca *selfSignedPair) (*selfSignedPair, error) {
+	now := s.clock()
+	notAfter := now.Add(s.CertValidity)
+	// A serving certificate outliving its CA would be rejected anyway.
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	commonName := s.SecretName
+	if len(s.DNSNames) > 0 {
+		commonName = s.DNSNames[0]
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    s.DNSNames,
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return generateSelfSignedPair(template, ca)
+}
+
+func (s *SelfSignedCertificates) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// generateSelfSignedPair creates a key and a certificate from the template, signed by the given CA or by itself when
+// the CA is nil.
+func generateSelfSignedPair(template *x509.Certificate, ca *selfSignedPair) (*selfSignedPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %w", err)
+	}
+	template.SerialNumber = serial
+
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate %s: %w", template.Subject.CommonName, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("encoding key: %w", err)
+	}
+
+	return parseSelfSignedPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+// parseSelfSignedPair parses a PEM encoded certificate and its ECDSA key, as generated by generateSelfSignedPair.
+func parseSelfSignedPair(certPEM, keyPEM []byte) (*selfSignedPair, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", errUnexpectedKeyType, pair.PrivateKey)
+	}
+	leaf, err := certificateLeaf(&pair)
+	if err != nil {
+		return nil, err
+	}
+	return &selfSignedPair{cert: leaf, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestSelfSignedCertificates(t *testing.T, now *time.Time) *SelfSignedCertificates {
+	t.Helper()
+	client := fake.NewClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "nri-metadata-injection"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "metadata-injection.newrelic.com"}},
+	})
+	return &SelfSignedCertificates{
+		Client:            client,
+		Namespace:         "newrelic",
+		SecretName:        "nri-metadata-injection-self-signed",
+		WebhookConfigName: "nri-metadata-injection",
+		DNSNames:          []string{"nri-metadata-injection.newrelic.svc"},
+		CAValidity:        10 * 365 * 24 * time.Hour,
+		CertValidity:      365 * 24 * time.Hour,
+		RenewBefore:       30 * 24 * time.Hour,
+		now:               func() time.Time { return *now },
+	}
+}
+
+func caBundle(t *testing.T, s *SelfSignedCertificates) []byte {
+	t.Helper()
+	config, err := s.Client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), s.WebhookConfigName, metav1.GetOptions{})
+	require.NoError(t, err)
+	return config.Webhooks[0].ClientConfig.CABundle
+}
+
+func secretData(t *testing.T, s *SelfSignedCertificates, key string) []byte {
+	t.Helper()
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(context.Background(), s.SecretName, metav1.GetOptions{})
+	require.NoError(t, err)
+	return secret.Data[key]
+}
+
+func TestSelfSignedCertificates_Ensure(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now()
+	now := start
+	s := newTestSelfSignedCertificates(t, &now)
+
+	cert, generated, err := s.Ensure(context.Background())
+	require.NoError(t, err)
+	assert.True(t, generated)
+
+	// The API server trusts the serving certificate through the caBundle.
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caBundle(t, s)))
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "nri-metadata-injection.newrelic.svc", Roots: roots, CurrentTime: now})
+	assert.NoError(t, err)
+
+	t.Run("stored certificates are reused", func(t *testing.T) {
+		again, generated, err := s.Ensure(context.Background())
+		require.NoError(t, err)
+		assert.False(t, generated)
+		assert.Equal(t, cert.Certificate, again.Certificate)
+	})
+
+	t.Run("serving certificate is renewed before expiring", func(t *testing.T) {
+		caPEM := secretData(t, s, secretCACertKey)
+		now = now.Add(s.CertValidity - s.RenewBefore + time.Hour)
+
+		renewed, generated, err := s.Ensure(context.Background())
+		require.NoError(t, err)
+		assert.True(t, generated)
+		assert.NotEqual(t, cert.Certificate, renewed.Certificate)
+		assert.Equal(t, caPEM, secretData(t, s, secretCACertKey), "the CA is still valid")
+		assert.Equal(t, caPEM, caBundle(t, s))
+	})
+
+	t.Run("CA is renewed before expiring, keeping the previous one trusted", func(t *testing.T) {
+		previousCAPEM := secretData(t, s, secretCACertKey)
+		now = start.Add(s.CAValidity - s.RenewBefore + time.Hour)
+
+		_, generated, err := s.Ensure(context.Background())
+		require.NoError(t, err)
+		assert.True(t, generated)
+		caPEM := secretData(t, s, secretCACertKey)
+		assert.NotEqual(t, previousCAPEM, caPEM)
+		assert.True(t, bytes.HasPrefix(caBundle(t, s), caPEM))
+		assert.True(t, bytes.Contains(caBundle(t, s), previousCAPEM))
+	})
+}
+
+func TestSelfSignedCertificates_EnsureDNSNamesChange(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	s := newTestSelfSignedCertificates(t, &now)
+	first, _, err := s.Ensure(context.Background())
+	require.NoError(t, err)
+
+	// The certificate served doesn't change while the Secret is up to date.
+	webhook := &Webhook{Logger: zap.NewNop().Sugar()}
+	assert.False(t, webhook.ServesCert(first))
+	webhook.SetCert(first)
+	again, generated, err := s.Ensure(context.Background())
+	require.NoError(t, err)
+	assert.False(t, generated)
+	assert.True(t, webhook.ServesCert(again))
+
+	s.DNSNames = append(s.DNSNames, "nri-metadata-injection.newrelic.svc.cluster.local")
+	cert, generated, err := s.Ensure(context.Background())
+	require.NoError(t, err)
+	assert.True(t, generated)
+	assert.Equal(t, s.DNSNames, cert.Leaf.DNSNames)
+	assert.False(t, webhook.ServesCert(cert))
+}
+
+func TestSelfSignedCertificates_EnsureWithoutWebhookConfig(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	s := newTestSelfSignedCertificates(t, &now)
+	s.WebhookConfigName = "missing"
+
+	_, _, err := s.Ensure(context.Background())
+	assert.ErrorIs(t, err, errWebhookConfigNotFound)
+	assert.Equal(t, certReloadReasonSelfSigned, certReloadReason(err))
+}
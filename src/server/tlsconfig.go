@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var (
+	errUnknownTLSVersion      = errors.New("unknown TLS version")
+	errTLSVersionRange        = errors.New("minimum TLS version greater than the maximum")
+	errUnknownCipherSuite     = errors.New("unknown cipher suite")
+	errInsecureCipherSuite    = errors.New("insecure cipher suite")
+	errCipherSuiteUnsupported = errors.New("cipher suite not supported by the allowed TLS versions")
+	errCipherSuitesTLS13      = errors.New("cipher suites can't be configured for TLS 1.3")
+	errUnknownCurve           = errors.New("unknown curve")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves are the key exchange mechanisms that can be configured, by their names and some common aliases.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"CURVEP256":      tls.CurveP256,
+	"P256":           tls.CurveP256,
+	"P-256":          tls.CurveP256,
+	"SECP256R1":      tls.CurveP256,
+	"CURVEP384":      tls.CurveP384,
+	"P384":           tls.CurveP384,
+	"P-384":          tls.CurveP384,
+	"SECP384R1":      tls.CurveP384,
+	"CURVEP521":      tls.CurveP521,
+	"P521":           tls.CurveP521,
+	"P-521":          tls.CurveP521,
+	"SECP521R1":      tls.CurveP521,
+}
+
+// TLSOptions are the settings of the TLS connections of the webhook server. Empty settings keep the Go defaults.
+type TLSOptions struct {
+	// MinVersion and MaxVersion are TLS versions like 1.2 or TLS1.3.
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are the names of the TLS 1.0 to 1.2 cipher suites, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// The TLS 1.3 cipher suites are not configurable.
+	CipherSuites []string
+	// Curves are the key exchange mechanisms, by order of preference, like X25519 or P-256.
+	Curves []string
+}
+
+// Apply validates the options and sets them in the given TLS config.
+func (o TLSOptions) Apply(config *tls.Config) error {
+	minVersion, err := parseTLSVersion(o.MinVersion)
+	if err != nil {
+		return fmt.Errorf("minimum version: %w", err)
+	}
+	maxVersion, err := parseTLSVersion(o.MaxVersion)
+	if err != nil {
+		return fmt.Errorf("maximum version: %w", err)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		return fmt.Errorf("%w: %s > %s", errTLSVersionRange, o.MinVersion, o.MaxVersion)
+	}
+
+	cipherSuites, err := parseCipherSuites(o.CipherSuites, minVersion, maxVersion)
+	if err != nil {
+		return err
+	}
+	curves, err := parseCurves(o.Curves)
+	if err != nil {
+		return err
+	}
+
+	config.MinVersion, config.MaxVersion = minVersion, maxVersion
+	config.CipherSuites = cipherSuites
+	config.CurvePreferences = curves
+	return nil
+}
+
+// parseTLSVersion returns the TLS version with the given name, or 0 when empty.
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	normalized := strings.ToUpper(strings.TrimSpace(name))
+	normalized = strings.TrimPrefix(strings.TrimPrefix(normalized, "TLSV"), "TLS")
+	version, ok := tlsVersions[strings.TrimSpace(normalized)]
+	if !ok {
+		return 0, fmt.Errorf("%w %q, expected one of 1.0, 1.1, 1.2, 1.3", errUnknownTLSVersion, name)
+	}
+	return version, nil
+}
+
+func parseCipherSuites(names []string, minVersion, maxVersion uint16) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if minVersion == tls.VersionTLS13 {
+		return nil, errCipherSuitesTLS13
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("%w %q", errInsecureCipherSuite, name)
+			}
+			return nil, fmt.Errorf("%w %q", errUnknownCipherSuite, name)
+		}
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool {
+			return (minVersion == 0 || v >= minVersion) && (maxVersion == 0 || v <= maxVersion) && v != tls.VersionTLS13
+		}) {
+			return nil, fmt.Errorf("%w: %q", errCipherSuiteUnsupported, name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, suite := range suites {
+		if strings.EqualFold(suite.Name, name) {
+			return suite
+		}
+	}
+	return nil
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", errUnknownCurve, name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSOptions_Apply(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		desc     string
+		options  TLSOptions
+		expected *tls.Config
+		err      error
+	}{
+		{
+			desc:     "defaults",
+			expected: &tls.Config{},
+		},
+		{
+			desc:     "TLS 1.3 only",
+			options:  TLSOptions{MinVersion: "TLS1.3"},
+			expected: &tls.Config{MinVersion: tls.VersionTLS13},
+		},
+		{
+			desc: "TLS 1.2 with FIPS approved suites and curves",
+			options: TLSOptions{
+				MinVersion:   "1.2",
+				MaxVersion:   "tlsv1.2",
+				CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", " tls_ecdhe_rsa_with_aes_128_gcm_sha256"},
+				Curves:       []string{"P-384", "CurveP256"},
+			},
+			expected: &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				MaxVersion:       tls.VersionTLS12,
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				CurvePreferences: []tls.CurveID{tls.CurveP384, tls.CurveP256},
+			},
+		},
+		{
+			desc:    "unknown version",
+			options: TLSOptions{MinVersion: "1.4"},
+			err:     errUnknownTLSVersion,
+		},
+		{
+			desc:    "inverted versions",
+			options: TLSOptions{MinVersion: "1.3", MaxVersion: "1.2"},
+			err:     errTLSVersionRange,
+		},
+		{
+			desc:    "unknown cipher suite",
+			options: TLSOptions{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_512_GCM"}},
+			err:     errUnknownCipherSuite,
+		},
+		{
+			desc:    "insecure cipher suite",
+			options: TLSOptions{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			err:     errInsecureCipherSuite,
+		},
+		{
+			desc:    "cipher suites with TLS 1.3 only",
+			options: TLSOptions{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			err:     errCipherSuitesTLS13,
+		},
+		{
+			desc:    "TLS 1.3 cipher suite",
+			options: TLSOptions{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			err:     errCipherSuiteUnsupported,
+		},
+		{
+			desc:    "cipher suite not supported by the versions",
+			options: TLSOptions{MaxVersion: "1.1", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			err:     errCipherSuiteUnsupported,
+		},
+		{
+			desc:    "unknown curve",
+			options: TLSOptions{Curves: []string{"X448"}},
+			err:     errUnknownCurve,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			t.Parallel()
+			config := &tls.Config{}
+			err := c.options.Apply(config)
+			if c.err != nil {
+				assert.ErrorIs(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, config)
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	errUnknownInjectionMode = errors.New("unknown injection mode")
+	errInvalidMountPath     = errors.New("the mount path must be an absolute path")
+)
+
+// InjectionMode selects how the metadata is exposed to the containers.
+type InjectionMode string
+
+const (
+	// InjectionModeEnv injects the metadata as environment variables, which are frozen when the container starts.
+	InjectionModeEnv InjectionMode = "env"
+	// InjectionModeVolume mounts the metadata as the files of a downwardAPI volume instead of the variables, so the
+	// label and annotation changes are seen at runtime.
+	InjectionModeVolume InjectionMode = "volume"
+	// InjectionModeBoth injects the variables and mounts the volume.
+	InjectionModeBoth InjectionMode = "both"
+)
+
+const (
+	// metadataVolumeName is the name of the downwardAPI volume added to the pods.
+	metadataVolumeName = "newrelic-metadata"
+	// defaultMetadataMountPath is the directory where the volume is mounted when none is configured.
+	defaultMetadataMountPath = "/etc/newrelic/metadata"
+	// metadataFileVar holds the path of the metadata file in the containers mounting the volume.
+	metadataFileVar = "NEW_RELIC_METADATA_FILE"
+	// metadataFileName is the file of the volume holding the metadata resolved at admission time, as JSON.
+	metadataFileName = "metadata.json"
+	// metadataAnnotation holds the metadata resolved at admission time, exposed as the metadata file of the volume.
+	metadataAnnotation = "metadata-injection.newrelic.com/metadata"
+	// metadataAnnotationFieldPath is the downward API field path of the metadata annotation.
+	metadataAnnotationFieldPath = "metadata.annotations['" + metadataAnnotation + "']"
+)
+
+// VolumeConfig configures the downwardAPI volume mounted in the volume and both injection modes. The volume holds
+// the labels and annotations of the pod, in the `labels` and `annotations` files, and the metadata resolved at
+// admission time in the `metadata.json` file.
+type VolumeConfig struct {
+	// MountPath is the directory where the volume is mounted in the mutated containers, /etc/newrelic/metadata by
+	// default.
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+func (v *VolumeConfig) compile() error {
+	if v.MountPath != "" && !path.IsAbs(v.MountPath) {
+		return fmt.Errorf("%w: %q", errInvalidMountPath, v.MountPath)
+	}
+	return nil
+}
+
+func (v *VolumeConfig) mountPath() string {
+	if v.MountPath == "" {
+		return defaultMetadataMountPath
+	}
+	return path.Clean(v.MountPath)
+}
+
+// injectsVariables reports whether the metadata is injected as environment variables.
+func (c *InjectionConfig) injectsVariables() bool {
+	return c.Mode != InjectionModeVolume
+}
+
+// mountsVolume reports whether the metadata volume is mounted in the mutated containers.
+func (c *InjectionConfig) mountsVolume() bool {
+	return c.Mode == InjectionModeVolume || c.Mode == InjectionModeBoth
+}
+
+// podMetadata is the content of the metadata file, resolved at admission time. The name of the pods created with a
+// generateName is not known yet, it is read from the downward API instead.
+type podMetadata struct {
+	ClusterName     string `json:"clusterName,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	PodName         string `json:"podName,omitempty"`
+	DeploymentName  string `json:"deploymentName,omitempty"`
+	ReplicaSetName  string `json:"replicaSetName,omitempty"`
+	StatefulSetName string `json:"statefulSetName,omitempty"`
+	DaemonSetName   string `json:"daemonSetName,omitempty"`
+	JobName         string `json:"jobName,omitempty"`
+	CronJobName     string `json:"cronJobName,omitempty"`
+}
+
+// mountsVolume reports whether the metadata volume is mounted in the given container, which is not the case when
+// the container already mounts another volume at the same path.
+func (m *podMutation) mountsVolume(container *corev1.Container) bool {
+	if !m.volume {
+		return false
+	}
+	mountPath := m.config.Volume.mountPath()
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == metadataVolumeName || path.Clean(mount.MountPath) == mountPath {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataFilePath returns the path of the metadata file in the given container, where the metadata volume is either
+// mounted by the webhook or already mounted by the pod, or false when the container doesn't get the file.
+func (m *podMutation) metadataFilePath(container *corev1.Container) (string, bool) {
+	if !m.volume {
+		return "", false
+	}
+	if m.mountsVolume(container) {
+		return path.Join(m.config.Volume.mountPath(), metadataFileName), true
+	}
+	for _, mount := range container.VolumeMounts {
+		if mount.Name != metadataVolumeName || mount.SubPathExpr != "" {
+			continue
+		}
+		switch mount.SubPath {
+		case "":
+			return path.Join(mount.MountPath, metadataFileName), true
+		case metadataFileName:
+			return path.Clean(mount.MountPath), true
+		}
+	}
+	return "", false
+}
+
+// metadataFileEnvVars returns the variable holding the path of the metadata file when the given container gets it.
+func (m *podMutation) metadataFileEnvVars(container *corev1.Container) []corev1.EnvVar {
+	filePath, ok := m.metadataFilePath(container)
+	if !ok {
+		return nil
+	}
+	return []corev1.EnvVar{createEnvVarFromString(metadataFileVar, filePath)}
+}
+
+// volumeMountPatch returns the patch mounting the metadata volume, read-only, in the container at the given index of
+// the given pod spec field.
+func (m *podMutation) volumeMountPatch(field string, index int, container *corev1.Container) patchOperation {
+	mount := corev1.VolumeMount{Name: metadataVolumeName, MountPath: m.config.Volume.mountPath(), ReadOnly: true}
+	basePath := fmt.Sprintf("/spec/%s/%d/volumeMounts", field, index)
+	if len(container.VolumeMounts) == 0 {
+		return patchOperation{Op: "add", Path: basePath, Value: []corev1.VolumeMount{mount}}
+	}
+	return patchOperation{Op: "add", Path: basePath + "/-", Value: mount}
+}
+
+// metadataVolumePatch returns the patch adding the metadata annotation and the downwardAPI volume exposing it, along
+// with the labels and annotations of the pod. The volume is not added again when the pod already has it.
+func (whsvr *Webhook) metadataVolumePatch(m *podMutation) ([]patchOperation, error) {
+	metadata, err := json.Marshal(podMetadata{
+		ClusterName:     whsvr.clusterName(m.config),
+		Namespace:       m.pod.Namespace,
+		PodName:         m.pod.Name,
+		DeploymentName:  m.owners.Deployment,
+		ReplicaSetName:  m.owners.ReplicaSet,
+		StatefulSetName: m.owners.StatefulSet,
+		DaemonSetName:   m.owners.DaemonSet,
+		JobName:         m.owners.Job,
+		CronJobName:     m.owners.CronJob,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding pod metadata: %w", err)
+	}
+
+	var patch []patchOperation
+	if len(m.pod.Annotations) == 0 {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{metadataAnnotation: string(metadata)},
+		})
+	} else {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(metadataAnnotation),
+			Value: string(metadata),
+		})
+	}
+
+	if hasMetadataVolume(m.pod) {
+		return patch, nil
+	}
+	volume := newMetadataVolume()
+	if len(m.pod.Spec.Volumes) == 0 {
+		return append(patch, patchOperation{Op: "add", Path: "/spec/volumes", Value: []corev1.Volume{volume}}), nil
+	}
+	return append(patch, patchOperation{Op: "add", Path: "/spec/volumes/-", Value: volume}), nil
+}
+
+// newMetadataVolume returns the downwardAPI volume exposing the labels and annotations of the pod, and the metadata
+// annotation as the metadata file.
+func newMetadataVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: metadataVolumeName,
+		VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{Items: []corev1.DownwardAPIVolumeFile{
+			{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+			{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+			{Path: metadataFileName, FieldRef: &corev1.ObjectFieldSelector{FieldPath: metadataAnnotationFieldPath}},
+		}}},
+	}
+}
+
+// escapeJSONPointer escapes a key to be used as a reference token of a JSON patch path.
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// hasMetadataVolume reports whether the pod already has the metadata volume.
+func hasMetadataVolume(pod *corev1.Pod) bool {
+	volume := podMetadataVolume(pod)
+	return volume != nil && isMetadataVolume(volume)
+}
+
+// hasForeignMetadataVolume reports whether the pod already has a volume named as the metadata volume which is not the
+// one added by the webhook, in which case the metadata volume can't be added nor mounted.
+func hasForeignMetadataVolume(pod *corev1.Pod) bool {
+	volume := podMetadataVolume(pod)
+	return volume != nil && !isMetadataVolume(volume)
+}
+
+// podMetadataVolume returns the volume of the pod named as the metadata volume, if any.
+func podMetadataVolume(pod *corev1.Pod) *corev1.Volume {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == metadataVolumeName {
+			return &pod.Spec.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// isMetadataVolume reports whether the volume is the downwardAPI volume exposing the metadata annotation as the
+// metadata file, as added by metadataVolumePatch.
+func isMetadataVolume(volume *corev1.Volume) bool {
+	if volume.DownwardAPI == nil {
+		return false
+	}
+	for _, item := range volume.DownwardAPI.Items {
+		if item.Path == metadataFileName && item.FieldRef != nil && item.FieldRef.FieldPath == metadataAnnotationFieldPath {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreatePatch_VolumeMode(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+mode: volume
+volume: {mountPath: /var/run/metadata/}
+containers:
+  exclude: [{name: sidecar}]
+`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{ClusterName: "test-cluster", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-pod",
+			Namespace:       "default",
+			OwnerReferences: controllerRef("StatefulSet", "web"),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+				{Name: "sidecar"},
+				{Name: "conflicting", VolumeMounts: []corev1.VolumeMount{{Name: "other", MountPath: "/var/run/metadata"}}},
+			},
+			Volumes: []corev1.Volume{{Name: "data"}},
+		},
+	}
+
+	patchBytes, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, config))
+	require.NoError(t, err)
+
+	var patches []patchOperation
+	require.NoError(t, json.Unmarshal(patchBytes, &patches))
+	require.Len(t, patches, 4)
+
+	// Only the metadata file variable is injected, and the volume is only mounted in the selected containers without
+	// another volume at the same path.
+	assert.Equal(t, "/spec/containers/0/env", patches[0].Path)
+	assert.Equal(t, []any{map[string]any{"name": metadataFileVar, "value": "/var/run/metadata/metadata.json"}}, patches[0].Value)
+	assert.Equal(t, "/spec/containers/0/volumeMounts/-", patches[1].Path)
+	assert.Equal(t, map[string]any{"name": metadataVolumeName, "mountPath": "/var/run/metadata", "readOnly": true}, patches[1].Value)
+
+	assert.Equal(t, "/metadata/annotations", patches[2].Path)
+	assert.Equal(t, map[string]any{
+		metadataAnnotation: `{"clusterName":"test-cluster","namespace":"default","podName":"test-pod","statefulSetName":"web"}`,
+	}, patches[2].Value)
+
+	assert.Equal(t, "/spec/volumes/-", patches[3].Path)
+	volume := patches[3].Value.(map[string]any)
+	assert.Equal(t, metadataVolumeName, volume["name"])
+	assert.Len(t, volume["downwardAPI"].(map[string]any)["items"], 3)
+}
+
+func TestCreatePatch_BothModes(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`mode: both`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{ClusterName: "test-cluster", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default", Annotations: map[string]string{"team": "a"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	m := whsvr.newPodMutation(context.Background(), pod, config)
+
+	patchBytes, err := whsvr.createPatch(m)
+	require.NoError(t, err)
+
+	var patches []patchOperation
+	require.NoError(t, json.Unmarshal(patchBytes, &patches))
+	assert.Equal(t, []string{
+		"/spec/containers/0/env", "/spec/containers/0/volumeMounts",
+		"/metadata/annotations/metadata-injection.newrelic.com~1metadata", "/spec/volumes",
+	}, firstPatchPaths(patches))
+	assert.True(t, m.injected["NEW_RELIC_METADATA_KUBERNETES_POD_NAME"])
+	assert.True(t, m.injected[metadataFileVar])
+}
+
+func TestCreateEphemeralContainersPatch_VolumeMode(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`mode: volume`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		EphemeralContainers: []corev1.EphemeralContainer{
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}},
+		},
+	}}
+
+	// The volume can't be added through the subresource.
+	patchBytes, err := whsvr.createEphemeralContainersPatch(whsvr.newPodMutation(context.Background(), pod, config), &corev1.Pod{})
+	require.NoError(t, err)
+	assert.Nil(t, patchBytes)
+
+	pod.Spec.Volumes = []corev1.Volume{newMetadataVolume()}
+	patchBytes, err = whsvr.createEphemeralContainersPatch(whsvr.newPodMutation(context.Background(), pod, config), &corev1.Pod{})
+	require.NoError(t, err)
+
+	var patches []patchOperation
+	require.NoError(t, json.Unmarshal(patchBytes, &patches))
+	assert.Equal(t, []string{"/spec/ephemeralContainers/0/env", "/spec/ephemeralContainers/0/volumeMounts"}, firstPatchPaths(patches))
+}
+
+func TestCreatePatch_VolumeMode_ForeignVolume(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`mode: volume`), nil)
+	require.NoError(t, err)
+
+	// The pod has its own volume with the name of the metadata one, so the metadata can't be mounted.
+	whsvr := &Webhook{ClusterName: "test-cluster", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}},
+			Volumes:    []corev1.Volume{{Name: metadataVolumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		},
+	}
+
+	patchBytes, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, config))
+	require.NoError(t, err)
+	assert.Nil(t, patchBytes)
+}
+
+func TestCreatePatch_VolumeMode_ExistingMount(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`mode: volume`), nil)
+	require.NoError(t, err)
+
+	// The pod was created from the spec of a mutated one, the containers already mount the metadata volume.
+	whsvr := &Webhook{ClusterName: "test-cluster", Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: metadataVolumeName, MountPath: "/metadata"}}},
+				{Name: "file", VolumeMounts: []corev1.VolumeMount{{Name: metadataVolumeName, MountPath: "/meta.json", SubPath: metadataFileName}}},
+				{Name: "labels", VolumeMounts: []corev1.VolumeMount{{Name: metadataVolumeName, MountPath: "/labels", SubPath: "labels"}}},
+			},
+			Volumes: []corev1.Volume{newMetadataVolume()},
+		},
+	}
+
+	patchBytes, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, config))
+	require.NoError(t, err)
+
+	var patches []patchOperation
+	require.NoError(t, json.Unmarshal(patchBytes, &patches))
+	require.Len(t, patches, 3)
+
+	// The variable points to the file where it is already mounted, and only the metadata annotation is refreshed.
+	assert.Equal(t, "/spec/containers/0/env", patches[0].Path)
+	assert.Equal(t, []any{map[string]any{"name": metadataFileVar, "value": "/metadata/metadata.json"}}, patches[0].Value)
+	assert.Equal(t, "/spec/containers/1/env", patches[1].Path)
+	assert.Equal(t, []any{map[string]any{"name": metadataFileVar, "value": "/meta.json"}}, patches[1].Value)
+	assert.Equal(t, "/metadata/annotations", patches[2].Path)
+}
@@ -3,24 +3,61 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-const replicaSetKind = "ReplicaSet"
+const (
+	replicaSetKind = "ReplicaSet"
+
+	ephemeralContainersSubResource = "ephemeralcontainers"
+
+	// injectAnnotation opts a pod out of the mutation when "false", or in when the webhook runs in opt-in mode.
+	injectAnnotation = "metadata-injection.newrelic.com/inject"
+	// excludeContainersAnnotation lists the names of the containers of the pod that must not be mutated, comma-separated.
+	excludeContainersAnnotation = "metadata-injection.newrelic.com/exclude-containers"
+)
+
+// Reasons for skipping the mutation of a pod, logged in the "skipped mutation" line.
+const (
+	skipReasonIgnoredNamespace       = "policy check (special namespaces)"
+	skipReasonPodAnnotation          = "pod annotation"
+	skipReasonNotOptedIn             = "opt-in mode (pod not annotated)"
+	skipReasonNamespaceSelector      = "namespace selector"
+	skipReasonNamespaceUnavailable   = "namespace labels unavailable"
+	skipReasonEphemeralDisabled      = "ephemeral containers injection disabled"
+	skipReasonUnsupportedSubresource = "unsupported subresource"
+	skipReasonContainerAnnotation    = "pod annotation (excluded container)"
+	skipReasonContainerFilters       = "container filters"
+)
+
+// Fields of the pod spec holding each class of containers, used to build the JSON patch paths.
+const (
+	containersField          = "containers"
+	initContainersField      = "initContainers"
+	ephemeralContainersField = "ephemeralContainers"
+)
 
 var (
 	runtimeScheme = runtime.NewScheme()
@@ -41,34 +78,174 @@ func createEnvVarFromString(envVarName, envVarValue string) corev1.EnvVar {
 	return corev1.EnvVar{Name: envVarName, Value: envVarValue}
 }
 
-// getEnvVarsToInject returns the environment variables to inject in the given container
-func (whsvr *Webhook) getEnvVarsToInject(pod *corev1.Pod, container *corev1.Container) []corev1.EnvVar {
-	vars := []corev1.EnvVar{
-		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", whsvr.ClusterName),
-		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_NODE_NAME", "spec.nodeName"),
-		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME", "metadata.namespace"),
-		createEnvVarFromFieldPath("NEW_RELIC_METADATA_KUBERNETES_POD_NAME", "metadata.name"),
-		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", container.Name),
-		createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_IMAGE_NAME", container.Image),
-	}
-
-	whsvr.Logger.Infow("creating env variables", "cluster_name", whsvr.ClusterName, "container_name", container.Name, "container_image", container.Image)
-	// Guess the name of the deployment. We check whether the Pod is Owned by a ReplicaSet and confirms with the
-	// naming convention for a Deployment. This can give a false positive if the user uses ReplicaSets directly.
-	if len(pod.OwnerReferences) == 1 && pod.OwnerReferences[0].Kind == replicaSetKind {
-		podParts := strings.Split(pod.GenerateName, "-")
-		if len(podParts) >= 3 {
-			deployment := strings.Join(podParts[:len(podParts)-2], "-")
-			vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME", deployment))
+// getEnvVarsToInject returns the environment variables to inject in the given container of the given pod spec field
+func (whsvr *Webhook) getEnvVarsToInject(m *podMutation, field string, container *corev1.Container) []corev1.EnvVar {
+	// In the volume mode, the metadata is only read from the files of the volume.
+	if !m.config.injectsVariables() {
+		return m.metadataFileEnvVars(container)
+	}
+
+	clusterName := whsvr.clusterName(m.config)
+	data := &variableTemplateData{
+		ClusterName: clusterName,
+		Pod:         &m.pod.ObjectMeta,
+		Container:   container,
+		Owners:      m.owners,
+	}
+
+	// Ephemeral containers have no resources to reference.
+	ephemeral := field == ephemeralContainersField
+
+	vars := make([]corev1.EnvVar, 0, len(m.config.Variables))
+	for i := range m.config.Variables {
+		if ephemeral && m.config.Variables[i].ResourceFieldRef != nil {
+			continue
+		}
+		envVar, ok, err := m.config.Variables[i].envVar(data)
+		if err != nil {
+			whsvr.Logger.Errorw("could not create env variable", "err", err, "container_name", container.Name)
+			continue
+		}
+		if ok {
+			vars = append(vars, envVar)
+		}
+	}
+	vars = append(vars, m.identity...)
+	if !ephemeral {
+		vars = append(vars, containerResourceEnvVars(container, m.config.ContainerResources)...)
+	}
+
+	whsvr.Logger.Infow("creating env variables", "cluster_name", clusterName, "container_name", container.Name, "container_image", container.Image)
+
+	ownerVars := []struct {
+		name  string
+		value string
+	}{
+		{"NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME", m.owners.Deployment},
+		{"NEW_RELIC_METADATA_KUBERNETES_REPLICASET_NAME", m.owners.ReplicaSet},
+		{"NEW_RELIC_METADATA_KUBERNETES_STATEFULSET_NAME", m.owners.StatefulSet},
+		{"NEW_RELIC_METADATA_KUBERNETES_DAEMONSET_NAME", m.owners.DaemonSet},
+		{"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME", m.owners.Job},
+		{"NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME", m.owners.CronJob},
+	}
+	for _, ownerVar := range ownerVars {
+		if ownerVar.value != "" {
+			vars = append(vars, createEnvVarFromString(ownerVar.name, ownerVar.value))
 		}
-		if pod.OwnerReferences[0].Name != "" {
-			vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_REPLICASET_NAME", pod.OwnerReferences[0].Name))
+	}
+
+	vars = renameVariables(vars, m.prefixes)
+	vars = append(vars, m.metadataFileEnvVars(container)...)
+
+	// The resource attributes reference the other variables, so they must be defined after them.
+	if m.config.OpenTelemetry {
+		if otelVar, ok := otelResourceAttributesEnvVar(vars, m.prefixes); ok {
+			vars = append(vars, otelVar)
 		}
 	}
 
 	return vars
 }
 
+// podMutation holds the data resolved once per admitted pod and shared by the mutation of all its containers.
+type podMutation struct {
+	pod                *corev1.Pod
+	config             *InjectionConfig
+	owners             workloadOwners
+	excludedContainers map[string]bool
+	// prefixes are the prefixes of the naming profiles active in the namespace of the pod.
+	prefixes []string
+	// identity are the variables of the pod identity fields enabled in the configuration.
+	identity []corev1.EnvVar
+	// volume is whether the metadata volume is mounted in the mutated containers. It is not when the pod already has
+	// another volume with the same name.
+	volume bool
+	// mounted is whether the metadata volume is mounted in any container, by the webhook or already by the pod, so it
+	// must be added to the pod along with the metadata annotation.
+	mounted bool
+	// envFromVariables holds, by container name, the variables defined through the envFrom of the container.
+	envFromVariables map[string]map[string]bool
+	// conflicts lists the container/variable pairs already defined when the conflict policy is fail.
+	conflicts []string
+	// defined lists the container/variable pairs already defined, whatever the conflict policy.
+	defined []string
+	// injected holds the names of the variables added or replaced in any container.
+	injected map[string]bool
+	// skippedContainers holds, by container name, why the container was not mutated.
+	skippedContainers map[string]string
+}
+
+func (whsvr *Webhook) newPodMutation(ctx context.Context, pod *corev1.Pod, config *InjectionConfig) *podMutation {
+	excluded := map[string]bool{}
+	for _, name := range strings.Split(pod.Annotations[excludeContainersAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[name] = true
+		}
+	}
+
+	return &podMutation{
+		pod:                pod,
+		config:             config,
+		owners:             whsvr.resolveOwners(ctx, pod),
+		excludedContainers: excluded,
+		prefixes:           config.Naming.namespacePrefixes(pod.Namespace),
+		identity:           podIdentityEnvVars(pod, config.PodIdentity),
+		volume:             config.mountsVolume() && !hasForeignMetadataVolume(pod),
+		envFromVariables:   whsvr.resolveEnvFrom(ctx, pod),
+		injected:           map[string]bool{},
+		skippedContainers:  map[string]string{},
+	}
+}
+
+// resolveEnvFrom returns the variables defined through the envFrom of each container of the pod.
+func (whsvr *Webhook) resolveEnvFrom(ctx context.Context, pod *corev1.Pod) map[string]map[string]bool {
+	variables := map[string]map[string]bool{}
+	if whsvr.EnvFrom == nil {
+		return variables
+	}
+
+	containers := make([]corev1.Container, 0, len(pod.Spec.Containers)+len(pod.Spec.InitContainers)+len(pod.Spec.EphemeralContainers))
+	containers = append(containers, pod.Spec.Containers...)
+	containers = append(containers, pod.Spec.InitContainers...)
+	for _, ephemeral := range pod.Spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(ephemeral.EphemeralContainerCommon))
+	}
+
+	for i := range containers {
+		if len(containers[i].EnvFrom) == 0 {
+			continue
+		}
+		names, err := whsvr.EnvFrom.variables(ctx, pod.Namespace, &containers[i])
+		if err != nil {
+			whsvr.Logger.Warnw("could not resolve envFrom sources", "namespace", pod.Namespace, "pod", pod.Name, "container", containers[i].Name, "err", err)
+		}
+		variables[containers[i].Name] = names
+	}
+	return variables
+}
+
+// audit returns the description of the mutation for the admission response.
+func (m *podMutation) audit() *admissionAudit {
+	return &admissionAudit{
+		injected:          slices.Sorted(maps.Keys(m.injected)),
+		skippedContainers: m.skippedContainers,
+		defined:           m.defined,
+		conflictPolicy:    m.config.ConflictPolicy,
+		unsupportedOwner:  unsupportedOwnerKind(m.pod),
+	}
+}
+
+// containerSkipReason returns why the container must not be mutated, or an empty string if it must be.
+func (m *podMutation) containerSkipReason(container *corev1.Container) string {
+	if m.excludedContainers[container.Name] {
+		return skipReasonContainerAnnotation
+	}
+	if !m.config.Containers.selects(container) {
+		return skipReasonContainerFilters
+	}
+	return ""
+}
+
 // Webhook is a webhook server that can accept requests from the Apiserver
 type Webhook struct {
 	sync.RWMutex
@@ -78,7 +255,35 @@ type Webhook struct {
 	ClusterName string
 	Logger      *zap.SugaredLogger
 	Server      *http.Server
-	CertWatcher *fsnotify.Watcher
+	// Config declares the variables to inject. When nil, DefaultInjectionConfig is used. It must only be replaced
+	// through SetConfig once the server is started.
+	Config *InjectionConfig
+	// Namespaces gets the labels of the namespaces, needed when the configuration has a namespace selector.
+	Namespaces *NamespaceResolver
+	// EnvFrom gets the variables defined through the envFrom of the containers, so the conflict policy also applies
+	// to them. When nil, only the env of the containers is considered.
+	EnvFrom *EnvFromResolver
+	// Metrics records the Prometheus metrics of the webhook. When nil, nothing is recorded.
+	Metrics *Metrics
+	// Owners resolves the top-level workload of the pods through the Kubernetes API. When nil, the Deployment
+	// is guessed from the pod name.
+	Owners *OwnerResolver
+	// InjectInitContainers enables the injection into the init containers of the pod.
+	InjectInitContainers bool
+	// InjectEphemeralContainers enables the injection into ephemeral containers added through the
+	// pods/ephemeralcontainers subresource.
+	InjectEphemeralContainers bool
+	// AdmissionWarnings enables the warnings of the admission responses about the conflicting variables and the
+	// unsupported owners, shown to the users by kubectl.
+	AdmissionWarnings bool
+	// ClientAuth verifies the certificates of the clients. When nil, any client can send admission requests.
+	ClientAuth *ClientAuth
+	// CertDNSNames are the DNS names the certificates loaded by ReloadCert must be valid for, usually the ones of
+	// the webhook service.
+	CertDNSNames []string
+
+	// certReloadErr is why the last certificate reload was rejected, nil once a certificate is set.
+	certReloadErr error
 }
 
 // GetCert returns the certificate that should be used by the server in the TLS handshake.
@@ -88,6 +293,33 @@ func (whsvr *Webhook) GetCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return whsvr.Cert, nil
 }
 
+// SetConfig atomically replaces the injection configuration. Admission requests being served keep using the
+// configuration they started with.
+func (whsvr *Webhook) SetConfig(config *InjectionConfig) {
+	whsvr.Lock()
+	defer whsvr.Unlock()
+	whsvr.Config = config
+}
+
+// injectionConfig returns the injection configuration in use.
+func (whsvr *Webhook) injectionConfig() *InjectionConfig {
+	whsvr.RLock()
+	defer whsvr.RUnlock()
+
+	if whsvr.Config == nil {
+		return defaultInjectionConfig()
+	}
+	return whsvr.Config
+}
+
+// clusterName returns the cluster name set in the configuration, or the one the webhook was started with.
+func (whsvr *Webhook) clusterName(config *InjectionConfig) string {
+	if config.ClusterName != "" {
+		return config.ClusterName
+	}
+	return whsvr.ClusterName
+}
+
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
@@ -95,94 +327,312 @@ type patchOperation struct {
 }
 
 // Check whether the target resource needs to be mutated
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
+func mutationRequired(ignoredList []namePattern, metadata *metav1.ObjectMeta) bool {
 	// skip special kubernetes system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			return false
+	return !matchesAny(ignoredList, metadata.Namespace)
+}
+
+// mutationSkipReason returns why the pod must not be mutated, or an empty string if it must be.
+func (whsvr *Webhook) mutationSkipReason(ctx context.Context, config *InjectionConfig, req *admissionv1.AdmissionRequest, pod *corev1.Pod) string {
+	if !mutationRequired(config.ignoredNamespaces, &pod.ObjectMeta) {
+		return skipReasonIgnoredNamespace
+	}
+
+	switch req.SubResource {
+	case "":
+	case ephemeralContainersSubResource:
+		if !whsvr.InjectEphemeralContainers {
+			return skipReasonEphemeralDisabled
 		}
+	default:
+		return skipReasonUnsupportedSubresource
 	}
-	return true
+
+	inject, annotated := podInjectAnnotation(pod)
+	if annotated && !inject {
+		return skipReasonPodAnnotation
+	}
+	if config.OptIn && !inject {
+		return skipReasonNotOptedIn
+	}
+
+	if config.namespaceSelector != nil {
+		if whsvr.Namespaces == nil {
+			return skipReasonNamespaceUnavailable
+		}
+		namespaceLabels, err := whsvr.Namespaces.labels(ctx, pod.Namespace)
+		if err != nil {
+			whsvr.Logger.Warnw("could not get namespace labels", "namespace", pod.Namespace, "err", err)
+			return skipReasonNamespaceUnavailable
+		}
+		if !config.namespaceSelector.Matches(namespaceLabels) {
+			return skipReasonNamespaceSelector
+		}
+	}
+
+	return ""
 }
 
-func (whsvr *Webhook) updateContainer(pod *corev1.Pod, index int, container *corev1.Container) (patch []patchOperation) {
-	// Create map with all environment variable names
-	envVarMap := map[string]bool{}
-	for _, envVar := range container.Env {
-		envVarMap[envVar.Name] = true
+// podInjectAnnotation returns the value of the inject annotation of the pod and whether it is set to a valid boolean.
+func podInjectAnnotation(pod *corev1.Pod) (bool, bool) {
+	value, ok := pod.Annotations[injectAnnotation]
+	if !ok {
+		return false, false
 	}
+	inject, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, false
+	}
+	return inject, true
+}
+
+// mutateContainer returns the patch for the container at the given index of the given pod spec field, or no patch if
+// the container is not selected for the mutation.
+func (whsvr *Webhook) mutateContainer(m *podMutation, field string, index int, container *corev1.Container) []patchOperation {
+	if reason := m.containerSkipReason(container); reason != "" {
+		whsvr.Logger.Infow("skipped container mutation", "namespace", m.pod.Namespace, "pod", m.pod.Name, "container", container.Name, "reason", reason)
+		whsvr.Metrics.observeSkippedMutation(reason)
+		m.skippedContainers[container.Name] = reason
+		return nil
+	}
+	patch := whsvr.updateContainer(m, field, index, container)
+	if m.mountsVolume(container) {
+		patch = append(patch, m.volumeMountPatch(field, index, container))
+	}
+	if _, ok := m.metadataFilePath(container); ok {
+		m.mounted = true
+	}
+	return patch
+}
 
-	// Create a patch for each EnvVar in toInject (if they are not yet defined on the container)
+// updateContainer returns the patch injecting the environment variables in the container at the given index of the
+// given pod spec field (containers, initContainers or ephemeralContainers).
+func (whsvr *Webhook) updateContainer(m *podMutation, field string, index int, container *corev1.Container) (patch []patchOperation) {
+	// Create map with all environment variable names and their position, the last one wins when duplicated
+	envVarMap := map[string]int{}
+	for i, envVar := range container.Env {
+		envVarMap[envVar.Name] = i
+	}
+
+	// Create a patch for each EnvVar in toInject, handling the ones already defined on the container by the conflict policy
 	first := len(envVarMap) == 0
 	var value interface{}
-	basePath := fmt.Sprintf("/spec/containers/%d/env", index)
-
-	for _, inject := range whsvr.getEnvVarsToInject(pod, container) {
-		if _, present := envVarMap[inject.Name]; !present {
-			value = inject
-			path := basePath
-
-			if first {
-				// For the first element we have to create the list
-				value = []corev1.EnvVar{inject}
-				first = false
-			} else {
-				// For the other elements we can append to the list
-				path = path + "/-"
+	basePath := fmt.Sprintf("/spec/%s/%d/env", field, index)
+
+	for _, inject := range whsvr.getEnvVarsToInject(m, field, container) {
+		existing, present := envVarMap[inject.Name]
+		fromEnvFrom := m.envFromVariables[container.Name][inject.Name]
+		if inject.Name == otelResourceAttributesVar && m.config.OpenTelemetry {
+			if present && container.Env[existing].ValueFrom == nil {
+				// The attributes already defined are merged rather than handled by the conflict policy. The variable
+				// is moved to the end of the list, after the variables it references.
+				merged := mergeOTELResourceAttributes(inject.Value, container.Env[existing].Value)
+				if merged != container.Env[existing].Value || existing != len(container.Env)-1 {
+					patch = append(patch,
+						patchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d", basePath, existing)},
+						patchOperation{Op: "add", Path: basePath + "/-", Value: createEnvVarFromString(inject.Name, merged)},
+					)
+					m.injected[inject.Name] = true
+				}
+				continue
+			}
+			if !present && fromEnvFrom {
+				// The variable defined through envFrom is hidden by the injected one, which references it instead.
+				inject.Value += ",$(" + otelResourceAttributesVar + ")"
+				fromEnvFrom = false
 			}
+		}
 
-			patch = append(patch, patchOperation{
-				Op:    "add",
-				Path:  path,
-				Value: value,
-			})
+		if present {
+			m.defined = append(m.defined, container.Name+"/"+inject.Name)
+			switch m.config.ConflictPolicy {
+			case ConflictPolicyReplace:
+				if !equality.Semantic.DeepEqual(container.Env[existing], inject) {
+					patch = append(patch, patchOperation{
+						Op:    "replace",
+						Path:  fmt.Sprintf("%s/%d", basePath, existing),
+						Value: inject,
+					})
+					m.injected[inject.Name] = true
+				}
+			case ConflictPolicyFail:
+				m.conflicts = append(m.conflicts, container.Name+"/"+inject.Name)
+			default:
+				// The variable defined by the user is kept.
+			}
+			continue
+		}
+
+		// Variables in env take precedence over the ones from envFrom, so replacing one only requires adding it.
+		if fromEnvFrom {
+			m.defined = append(m.defined, container.Name+"/"+inject.Name)
+			if m.config.ConflictPolicy == ConflictPolicyFail {
+				m.conflicts = append(m.conflicts, container.Name+"/"+inject.Name)
+			}
+			if m.config.ConflictPolicy != ConflictPolicyReplace {
+				continue
+			}
 		}
+
+		m.injected[inject.Name] = true
+
+		value = inject
+		path := basePath
+
+		if first {
+			// For the first element we have to create the list
+			value = []corev1.EnvVar{inject}
+			first = false
+		} else {
+			// For the other elements we can append to the list
+			path = path + "/-"
+		}
+
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
 	}
 	return patch
 }
 
 // create mutation patch for resources
-func (whsvr *Webhook) createPatch(pod *corev1.Pod) ([]byte, error) {
+func (whsvr *Webhook) createPatch(m *podMutation) ([]byte, error) {
 	var patch []patchOperation
+	pod := m.pod
 
 	for i, container := range pod.Spec.Containers {
-		patch = append(patch, whsvr.updateContainer(pod, i, &container)...)
+		patch = append(patch, whsvr.mutateContainer(m, containersField, i, &container)...)
+	}
+
+	if whsvr.InjectInitContainers {
+		for i, container := range pod.Spec.InitContainers {
+			patch = append(patch, whsvr.mutateContainer(m, initContainersField, i, &container)...)
+		}
+	}
+
+	if m.mounted {
+		volumePatch, err := whsvr.metadataVolumePatch(m)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, volumePatch...)
+	}
+
+	return marshalPatch(patch)
+}
+
+// create mutation patch for the ephemeral containers added to a pod through the pods/ephemeralcontainers subresource.
+// Ephemeral containers already present in the old object are immutable, so only the new ones are mutated.
+func (whsvr *Webhook) createEphemeralContainersPatch(m *podMutation, oldPod *corev1.Pod) ([]byte, error) {
+	var patch []patchOperation
+	pod := m.pod
+
+	// The volumes of the pod can't be changed through the subresource, so the metadata volume is only mounted when the
+	// pod already has it.
+	m.volume = m.volume && hasMetadataVolume(pod)
+
+	existing := map[string]bool{}
+	for _, container := range oldPod.Spec.EphemeralContainers {
+		existing[container.Name] = true
 	}
 
+	for i, ephemeral := range pod.Spec.EphemeralContainers {
+		if existing[ephemeral.Name] {
+			continue
+		}
+		container := corev1.Container(ephemeral.EphemeralContainerCommon)
+		patch = append(patch, whsvr.mutateContainer(m, ephemeralContainersField, i, &container)...)
+	}
+
+	return marshalPatch(patch)
+}
+
+// marshalPatch encodes the patch operations, returning no patch at all when there is nothing to change, since a
+// `null` JSON patch is rejected by the Apiserver.
+func marshalPatch(patch []patchOperation) ([]byte, error) {
+	if len(patch) == 0 {
+		return nil, nil
+	}
 	return json.Marshal(patch)
 }
 
-// main mutation process
-func (whsvr *Webhook) mutate(ar *admissionv1.AdmissionReview) ([]byte, error) {
+// envVarConflictError is returned by mutate when the conflict policy is fail and some of the containers already
+// define variables to inject.
+type envVarConflictError struct {
+	conflicts []string
+}
+
+func (e *envVarConflictError) Error() string {
+	return "environment variables managed by the metadata injection are already defined: " + strings.Join(e.conflicts, ", ")
+}
+
+// main mutation process, returning the patch and the audit describing it
+func (whsvr *Webhook) mutate(ctx context.Context, ar *admissionv1.AdmissionReview) ([]byte, *admissionAudit, error) {
 	req := ar.Request
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		whsvr.Logger.Errorw("could not unmarshal raw object", "err", err, "object", string(req.Object.Raw))
-		return nil, err
+		return nil, nil, fmt.Errorf("%w: %w", errInvalidObject, err)
+	}
+
+	// the namespace of the object can be empty on creation, it is then the one of the request
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
 	}
 
 	whsvr.Logger.Infow("received admission review", "kind", req.Kind, "namespace", req.Namespace, "name",
-		req.Name, "pod", pod.Name, "UID", req.UID, "operation", req.Operation, "userinfo", req.UserInfo)
+		req.Name, "pod", pod.Name, "UID", req.UID, "operation", req.Operation, "userinfo", req.UserInfo, "dryRun", req.DryRun)
+	ctx = withDryRun(ctx, req)
+
+	// the configuration is read once so that a reload does not affect the mutation of this pod
+	config := whsvr.injectionConfig()
 
 	// determine whether to perform mutation
-	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
-		whsvr.Logger.Infow("skipped mutation", "namespace", pod.Namespace, "pod", pod.Name, "reason", "policy check (special namespaces)")
-		return nil, nil
+	if reason := whsvr.mutationSkipReason(ctx, config, req, &pod); reason != "" {
+		whsvr.Logger.Infow("skipped mutation", "namespace", pod.Namespace, "pod", pod.Name, "reason", reason)
+		whsvr.Metrics.observeSkippedMutation(reason)
+		return nil, &admissionAudit{skipReason: reason}, nil
 	}
 
-	patchBytes, err := whsvr.createPatch(&pod)
+	m := whsvr.newPodMutation(ctx, &pod, config)
+
+	var patchBytes []byte
+	var err error
+	if req.SubResource == ephemeralContainersSubResource {
+		var oldPod corev1.Pod
+		if len(req.OldObject.Raw) > 0 {
+			if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+				whsvr.Logger.Errorw("could not unmarshal raw old object", "err", err, "object", string(req.OldObject.Raw))
+				return nil, nil, fmt.Errorf("%w: %w", errInvalidObject, err)
+			}
+		}
+		patchBytes, err = whsvr.createEphemeralContainersPatch(m, &oldPod)
+	} else {
+		patchBytes, err = whsvr.createPatch(m)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	if len(m.conflicts) > 0 {
+		whsvr.Logger.Infow("rejected mutation", "namespace", pod.Namespace, "pod", pod.Name, "conflicts", m.conflicts)
+		return nil, nil, &envVarConflictError{conflicts: m.conflicts}
+	}
+
+	whsvr.Metrics.observePatchSize(len(patchBytes))
 	whsvr.Logger.Infow("admission response created", "response", string(patchBytes))
-	return patchBytes, nil
+	return patchBytes, m.audit(), nil
 }
 
 // Serve method for webhook server
 func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 
+	start := time.Now()
+	defer func() { whsvr.Metrics.observeRequestDuration(time.Since(start).Seconds()) }()
+
 	if whsvr.Logger == nil {
 		whsvr.Logger = zap.NewNop().Sugar()
 	}
@@ -206,61 +656,86 @@ func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	admissionReviewRequest := admissionv1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &admissionReviewRequest); err != nil {
+	review, gvk, err := decodeAdmissionReview(body)
+	if err != nil && gvk.Empty() {
 		whsvr.Logger.Errorw("can't decode body", "err", err, "body", body)
+		whsvr.Metrics.observeDecodeError()
 		http.Error(w, fmt.Sprintf("could not decode request body: %q", err.Error()), http.StatusBadRequest)
 		return
 	}
-
-	if len(admissionReviewRequest.Request.Object.Raw) == 0 {
-		whsvr.Logger.Errorw("object not present in request body", "body", body)
-		http.Error(w, fmt.Sprintf("object not present in request body: %q", body), http.StatusBadRequest)
-		return
+	if err == nil && review.Request == nil {
+		err = fmt.Errorf("%w: request not present in request body", errInvalidAdmissionReview)
 	}
-
-	patch, err := whsvr.mutate(&admissionReviewRequest)
+	// The version of the AdmissionReview is known, so the error is reported in the status of the response.
 	if err != nil {
-		whsvr.Logger.Errorw("error during mutation", "err", err)
-		http.Error(w, fmt.Sprintf("error during mutation: %q", err.Error()), http.StatusInternalServerError)
+		whsvr.Logger.Errorw("invalid admission review", "err", err, "body", body)
+		whsvr.Metrics.observeDecodeError()
+		whsvr.writeResponse(w, gvk, whsvr.errorResponse(requestUID(body), err))
 		return
 	}
 
-	switch admissionReviewRequest.APIVersion {
-	// Types should be backward compatible between v1 and v1beta1 according to
-	// https://kubernetes.io/docs/reference/access-authn-authz/extensible-admission-controllers/#webhook-request-and-response.
-	case "admission.k8s.io/v1", "admission.k8s.io/v1beta1":
-	default:
-		whsvr.Logger.Errorw("unsupported admission API Version request", "version", admissionReviewRequest.APIVersion)
-		http.Error(w, fmt.Sprintf("unsupported admission API Version request: %q", admissionReviewRequest.APIVersion), http.StatusBadRequest)
-		return
+	req := review.Request
+	// Allow the creation of the pod unless the request is invalid, or the mutation fails or is rejected.
+	response := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	observeResult := func(result string) {
+		whsvr.Metrics.observeAdmission(string(req.Operation), req.Namespace, result)
 	}
 
-	admissionReviewResponse := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       admissionReviewRequest.Kind,
-			APIVersion: admissionReviewRequest.APIVersion,
-		},
-		Response: &admissionv1.AdmissionResponse{
-			Allowed: true, // Always allow the creation of the pod since this webhook does not act as Validating Webhook.
-		},
+	var patch []byte
+	var audit *admissionAudit
+	if len(req.Object.Raw) == 0 {
+		whsvr.Logger.Errorw("object not present in request body", "body", body)
+		whsvr.Metrics.observeDecodeError()
+		err = fmt.Errorf("%w: object not present in request body", errInvalidObject)
+	} else {
+		patch, audit, err = whsvr.mutate(r.Context(), review)
 	}
 
-	if len(patch) > 0 {
-		admissionReviewResponse.Response.Patch = patch
-		admissionReviewResponse.Response.PatchType = func() *admissionv1.PatchType {
-			pt := admissionv1.PatchTypeJSONPatch // Only PatchTypeJSONPatch is allowed by now.
-			return &pt
-		}()
+	var conflictErr *envVarConflictError
+	switch {
+	case errors.As(err, &conflictErr):
+		observeResult(admissionResultDenied)
+		response.Allowed = false
+		response.Result = failureStatus(http.StatusConflict, metav1.StatusReasonConflict, conflictErr.Error())
+	case err != nil:
+		observeResult(admissionResultError)
+		response = whsvr.errorResponse(req.UID, err)
+	case len(patch) > 0:
+		observeResult(admissionResultMutated)
+		patchType := admissionv1.PatchTypeJSONPatch // Only PatchTypeJSONPatch is allowed by now.
+		response.Patch, response.PatchType = patch, &patchType
+	default:
+		observeResult(admissionResultNotMutated)
 	}
+	response.AuditAnnotations = audit.annotations()
+	if whsvr.AdmissionWarnings {
+		response.Warnings = append(response.Warnings, audit.warnings()...)
+	}
+
+	whsvr.writeResponse(w, gvk, response)
+}
 
-	if admissionReviewRequest.Request != nil {
-		admissionReviewResponse.Response.UID = admissionReviewRequest.Request.UID
+// errorResponse returns the response to an admission request that can't be mutated because of the error, reported
+// in its status. The pod is admitted as it is unless the error policy of the class of the error is deny.
+func (whsvr *Webhook) errorResponse(uid types.UID, err error) *admissionv1.AdmissionResponse {
+	class, status := errorStatus(err)
+	response := &admissionv1.AdmissionResponse{UID: uid, Allowed: true, Result: status}
+	if whsvr.injectionConfig().failurePolicy(class) == FailurePolicyDeny {
+		whsvr.Logger.Errorw("error during mutation, denying the pod", "class", class, "err", err)
+		response.Allowed = false
+	} else {
+		// The pod is admitted as it is, the warning tells the user the metadata is missing.
+		whsvr.Logger.Warnw("error during mutation, allowing the pod without mutating it", "class", class, "err", err)
+		response.Warnings = []string{truncateWarning("New Relic metadata not injected: " + status.Message)}
 	}
+	return response
+}
 
-	resp, err := json.Marshal(admissionReviewResponse)
+// writeResponse writes the response in an AdmissionReview of the given version.
+func (whsvr *Webhook) writeResponse(w http.ResponseWriter, gvk schema.GroupVersionKind, response *admissionv1.AdmissionResponse) {
+	resp, err := encodeAdmissionReview(gvk, response)
 	if err != nil {
-		whsvr.Logger.Errorw("can't decode response", "err", err)
+		whsvr.Logger.Errorw("can't encode response", "err", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -2,22 +2,30 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestServeHTTP(t *testing.T) {
@@ -33,8 +41,18 @@ func TestServeHTTP(t *testing.T) {
 	}
 
 	missingObjectRequestBody := bytes.Replace(makeTestData(t, "default"), []byte("\"object\""), []byte("\"foo\""), -1)
+	missingRequestBody := []byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1"}`)
+	invalidObjectRequestBody := bytes.Replace(makeTestData(t, "default"), []byte("\"containers\":["), []byte("\"containers\":\"foo\",\"bar\":["), 1)
+	v1beta1RequestBody := bytes.Replace(makeTestData(t, "default"), []byte("admission.k8s.io/v1"), []byte("admission.k8s.io/v1beta1"), 1)
+	unsupportedRequestBody := bytes.Replace(makeTestData(t, "default"), []byte("admission.k8s.io/v1"), []byte("admission.k8s.io/v2"), 1)
 
 	patchTypeForValidBody := admissionv1.PatchTypeJSONPatch
+	auditAnnotationsForValidBody := map[string]string{
+		"injected-variables": "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME,NEW_RELIC_METADATA_KUBERNETES_CONTAINER_IMAGE_NAME," +
+			"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME,NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME," +
+			"NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME,NEW_RELIC_METADATA_KUBERNETES_NODE_NAME," +
+			"NEW_RELIC_METADATA_KUBERNETES_POD_NAME,NEW_RELIC_METADATA_KUBERNETES_REPLICASET_NAME",
+	}
 	cases := []struct {
 		name                      string
 		requestBody               []byte
@@ -54,11 +72,12 @@ func TestServeHTTP(t *testing.T) {
 					APIVersion: "admission.k8s.io/v1",
 				},
 				Response: &admissionv1.AdmissionResponse{
-					UID:       types.UID("1"),
-					Allowed:   true,
-					Result:    nil,
-					Patch:     expectedPatchForValidBody.Bytes(),
-					PatchType: &patchTypeForValidBody,
+					UID:              types.UID("1"),
+					Allowed:          true,
+					Result:           nil,
+					Patch:            expectedPatchForValidBody.Bytes(),
+					PatchType:        &patchTypeForValidBody,
+					AuditAnnotations: auditAnnotationsForValidBody,
 				},
 			},
 		},
@@ -73,11 +92,12 @@ func TestServeHTTP(t *testing.T) {
 					APIVersion: "admission.k8s.io/v1",
 				},
 				Response: &admissionv1.AdmissionResponse{
-					UID:       types.UID("1"),
-					Allowed:   true,
-					Result:    nil,
-					Patch:     nil,
-					PatchType: nil,
+					UID:              types.UID("1"),
+					Allowed:          true,
+					Result:           nil,
+					Patch:            nil,
+					PatchType:        nil,
+					AuditAnnotations: map[string]string{"skip-reason": "policy check (special namespaces)"},
 				},
 			},
 		},
@@ -102,11 +122,116 @@ func TestServeHTTP(t *testing.T) {
 			expectedBodyWhenHTTPError: "could not decode request body: \"yaml: control characters are not allowed\"\n",
 		},
 		{
-			name:                      "mutation fails - object not present in request body",
-			requestBody:               missingObjectRequestBody,
-			contentType:               "application/json",
-			expectedStatusCode:        http.StatusBadRequest,
-			expectedBodyWhenHTTPError: fmt.Sprintf("object not present in request body: %q\n", missingObjectRequestBody),
+			name:               "unsupported AdmissionReview version",
+			requestBody:        unsupportedRequestBody,
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v2",
+				},
+				Response: &admissionv1.AdmissionResponse{
+					UID:     types.UID("1"),
+					Allowed: true,
+					Result: &metav1.Status{
+						Status:  metav1.StatusFailure,
+						Message: "unsupported admission API Version request: \"admission.k8s.io/v2\"",
+						Reason:  metav1.StatusReasonBadRequest,
+						Code:    http.StatusBadRequest,
+					},
+					Warnings: []string{"New Relic metadata not injected: unsupported admission API Version request: \"admission.k8s.io/v2\""},
+				},
+			},
+		},
+		{
+			name:               "request not present in request body",
+			requestBody:        missingRequestBody,
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Response: &admissionv1.AdmissionResponse{
+					UID:     "",
+					Allowed: true,
+					Result: &metav1.Status{
+						Status:  metav1.StatusFailure,
+						Message: "invalid admission review: request not present in request body",
+						Reason:  metav1.StatusReasonBadRequest,
+						Code:    http.StatusBadRequest,
+					},
+					Warnings: []string{"New Relic metadata not injected: invalid admission review: request not present in request body"},
+				},
+			},
+		},
+		{
+			name:               "mutation applied - v1beta1 AdmissionReview",
+			requestBody:        v1beta1RequestBody,
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1beta1",
+				},
+				Response: &admissionv1.AdmissionResponse{
+					UID:              types.UID("1"),
+					Allowed:          true,
+					Result:           nil,
+					Patch:            expectedPatchForValidBody.Bytes(),
+					PatchType:        &patchTypeForValidBody,
+					AuditAnnotations: auditAnnotationsForValidBody,
+				},
+			},
+		},
+		{
+			name:               "mutation fails - object not present in request body",
+			requestBody:        missingObjectRequestBody,
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Response: &admissionv1.AdmissionResponse{
+					UID:     types.UID("1"),
+					Allowed: true,
+					Result: &metav1.Status{
+						Status:  metav1.StatusFailure,
+						Message: "invalid object in admission request: object not present in request body",
+						Reason:  metav1.StatusReasonBadRequest,
+						Code:    http.StatusBadRequest,
+					},
+					Warnings: []string{"New Relic metadata not injected: invalid object in admission request: object not present in request body"},
+				},
+			},
+		},
+		{
+			name:               "mutation fails - invalid pod in request body",
+			requestBody:        invalidObjectRequestBody,
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       "AdmissionReview",
+					APIVersion: "admission.k8s.io/v1",
+				},
+				Response: &admissionv1.AdmissionResponse{
+					UID:     types.UID("1"),
+					Allowed: true,
+					Result: &metav1.Status{
+						Status:  metav1.StatusFailure,
+						Message: "invalid object in admission request: json: cannot unmarshal string into Go struct field Pod.spec.containers of type []v1.Container",
+						Reason:  metav1.StatusReasonBadRequest,
+						Code:    http.StatusBadRequest,
+					},
+					Warnings: []string{"New Relic metadata not injected: invalid object in admission request: json: cannot unmarshal string into Go struct fi..."},
+				},
+			},
 		},
 	}
 
@@ -232,7 +357,7 @@ func TestUpdateContainer_WithExistingEnvVars(t *testing.T) {
 		},
 	}
 
-	patches := whsvr.updateContainer(pod, 0, container)
+	patches := whsvr.updateContainer(whsvr.newPodMutation(context.Background(), pod, whsvr.injectionConfig()), containersField, 0, container)
 
 	// Should only add env vars that don't already exist
 	// NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME should not be added since it already exists
@@ -274,9 +399,638 @@ func TestUpdateContainer_EmptyContainer(t *testing.T) {
 		Env:   []corev1.EnvVar{}, // Empty env vars
 	}
 
-	patches := whsvr.updateContainer(pod, 0, container)
+	patches := whsvr.updateContainer(whsvr.newPodMutation(context.Background(), pod, whsvr.injectionConfig()), containersField, 0, container)
 
 	// Should add all New Relic env vars
 	assert.NotEmpty(t, patches)
 	assert.True(t, len(patches) > 0, "Should generate patches for empty container")
 }
+
+func TestCreatePatch_InitContainers(t *testing.T) {
+	t.Parallel()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "init-image:latest"}},
+			Containers:     []corev1.Container{{Name: "app", Image: "app-image:latest"}},
+		},
+	}
+
+	cases := []struct {
+		name                 string
+		injectInitContainers bool
+		expectedPaths        []string
+	}{
+		{
+			name:                 "init containers disabled",
+			injectInitContainers: false,
+			expectedPaths:        []string{"/spec/containers/0/env"},
+		},
+		{
+			name:                 "init containers enabled",
+			injectInitContainers: true,
+			expectedPaths:        []string{"/spec/containers/0/env", "/spec/initContainers/0/env"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			whsvr := &Webhook{
+				ClusterName:          "test-cluster",
+				Logger:               zap.NewNop().Sugar(),
+				InjectInitContainers: c.injectInitContainers,
+			}
+
+			patchBytes, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, whsvr.injectionConfig()))
+			assert.NoError(t, err)
+
+			var patches []patchOperation
+			assert.NoError(t, json.Unmarshal(patchBytes, &patches))
+			assert.ElementsMatch(t, c.expectedPaths, firstPatchPaths(patches))
+		})
+	}
+}
+
+func TestMutate_EphemeralContainers(t *testing.T) {
+	t.Parallel()
+
+	oldPod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app-image:latest"}},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-1", Image: "busybox"}},
+			},
+		},
+	}
+	pod := *oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-2", Image: "busybox"},
+	})
+
+	raw, err := json.Marshal(&pod)
+	assert.NoError(t, err)
+	oldRaw, err := json.Marshal(&oldPod)
+	assert.NoError(t, err)
+
+	review := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			Operation:   admissionv1.Update,
+			SubResource: ephemeralContainersSubResource,
+			Object:      runtime.RawExtension{Raw: raw},
+			OldObject:   runtime.RawExtension{Raw: oldRaw},
+		},
+	}
+
+	t.Run("ephemeral containers disabled", func(t *testing.T) {
+		t.Parallel()
+
+		whsvr := &Webhook{Logger: zap.NewNop().Sugar()}
+		patchBytes, _, err := whsvr.mutate(context.Background(), review)
+		assert.NoError(t, err)
+		assert.Nil(t, patchBytes)
+	})
+
+	t.Run("ephemeral containers enabled", func(t *testing.T) {
+		t.Parallel()
+
+		whsvr := &Webhook{Logger: zap.NewNop().Sugar(), InjectEphemeralContainers: true}
+		patchBytes, _, err := whsvr.mutate(context.Background(), review)
+		assert.NoError(t, err)
+
+		var patches []patchOperation
+		assert.NoError(t, json.Unmarshal(patchBytes, &patches))
+		// Only the newly added ephemeral container is mutated, regular containers are immutable on this subresource.
+		assert.Equal(t, []string{"/spec/ephemeralContainers/1/env"}, firstPatchPaths(patches))
+	})
+}
+
+func TestUpdateContainer_EphemeralContainerResources(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+variables:
+  - {name: FOO, value: bar}
+  - {name: CPU_LIMIT, resourceFieldRef: {resource: limits.cpu}}
+`), nil)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{Logger: zap.NewNop().Sugar()}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	m := whsvr.newPodMutation(context.Background(), pod, config)
+
+	patches := whsvr.updateContainer(m, containersField, 0, &corev1.Container{Name: "app"})
+	assert.Len(t, patches, 2)
+
+	// Ephemeral containers have no resources, the API server would reject the patch referencing them.
+	patches = whsvr.updateContainer(m, ephemeralContainersField, 0, &corev1.Container{Name: "debugger"})
+	assert.Equal(t, []patchOperation{{
+		Op:    "add",
+		Path:  "/spec/ephemeralContainers/0/env",
+		Value: []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+	}}, patches)
+}
+
+// firstPatchPaths returns the paths of the patch operations creating an env list, one per mutated container.
+func firstPatchPaths(patches []patchOperation) []string {
+	var paths []string
+	for _, patch := range patches {
+		if !strings.HasSuffix(patch.Path, "/-") {
+			paths = append(paths, patch.Path)
+		}
+	}
+	return paths
+}
+
+func TestSetConfig(t *testing.T) {
+	t.Parallel()
+
+	whsvr := &Webhook{
+		ClusterName: "foobar",
+		Logger:      zap.NewNop().Sugar(),
+	}
+
+	config, err := ParseInjectionConfig([]byte(`
+clusterName: reloaded
+ignoredNamespaces: [default]
+variables:
+  - name: NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME
+    template: "{{ .ClusterName }}"
+`), nil)
+	assert.NoError(t, err)
+	whsvr.SetConfig(config)
+
+	mutate := func(namespace string) []patchOperation {
+		var review admissionv1.AdmissionReview
+		assert.NoError(t, json.Unmarshal(makeTestData(t, namespace), &review))
+
+		patchBytes, _, err := whsvr.mutate(context.Background(), &review)
+		assert.NoError(t, err)
+		if patchBytes == nil {
+			return nil
+		}
+		var patches []patchOperation
+		assert.NoError(t, json.Unmarshal(patchBytes, &patches))
+		return patches
+	}
+
+	assert.Nil(t, mutate("default"), "namespaces ignored in the new config must not be mutated")
+
+	patches := mutate("kube-system")
+	assert.Equal(t, "/spec/containers/0/env", patches[0].Path)
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"name":  "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+		"value": "reloaded",
+	}}, patches[0].Value)
+}
+
+func TestMutationSkipReason(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "enabled", Labels: map[string]string{"newrelic-metadata-injection": "enabled"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "disabled"}},
+	)
+	namespaces := NewNamespaceResolver(client, time.Minute)
+
+	selectorConfig, err := ParseInjectionConfig([]byte(`
+namespaceSelector:
+  matchLabels:
+    newrelic-metadata-injection: enabled
+`), nil)
+	require.NoError(t, err)
+	optInConfig, err := ParseInjectionConfig([]byte(`optIn: true`), nil)
+	require.NoError(t, err)
+
+	pod := func(namespace string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: namespace, Annotations: annotations}}
+	}
+	optedOut := map[string]string{injectAnnotation: "false"}
+	optedIn := map[string]string{injectAnnotation: "true"}
+
+	cases := []struct {
+		name       string
+		config     *InjectionConfig
+		namespaces *NamespaceResolver
+		pod        *corev1.Pod
+		expected   string
+	}{
+		{name: "default", config: DefaultInjectionConfig(), pod: pod("default", nil), expected: ""},
+		{name: "ignored namespace", config: DefaultInjectionConfig(), pod: pod("kube-system", optedIn), expected: skipReasonIgnoredNamespace},
+		{name: "pod opted out", config: DefaultInjectionConfig(), pod: pod("default", optedOut), expected: skipReasonPodAnnotation},
+		{name: "invalid annotation is ignored", config: DefaultInjectionConfig(), pod: pod("default", map[string]string{injectAnnotation: "nope"}), expected: ""},
+		{name: "opt-in mode without annotation", config: optInConfig, pod: pod("default", nil), expected: skipReasonNotOptedIn},
+		{name: "opt-in mode with pod opted in", config: optInConfig, pod: pod("default", optedIn), expected: ""},
+		{name: "namespace matching selector", config: selectorConfig, namespaces: namespaces, pod: pod("enabled", nil), expected: ""},
+		{name: "namespace not matching selector", config: selectorConfig, namespaces: namespaces, pod: pod("disabled", nil), expected: skipReasonNamespaceSelector},
+		{name: "namespace not found", config: selectorConfig, namespaces: namespaces, pod: pod("missing", nil), expected: skipReasonNamespaceUnavailable},
+		{name: "namespace selector without resolver", config: selectorConfig, pod: pod("enabled", nil), expected: skipReasonNamespaceUnavailable},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			whsvr := &Webhook{Logger: zap.NewNop().Sugar(), Namespaces: c.namespaces}
+			reason := whsvr.mutationSkipReason(context.Background(), c.config, &admissionv1.AdmissionRequest{}, c.pod)
+			assert.Equal(t, c.expected, reason)
+		})
+	}
+}
+
+func TestCreatePatch_ContainerFilters(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte(`
+containers:
+  include:
+    - image: "/^registry.example.com//"
+  exclude:
+    - name: "*-proxy"
+`), nil)
+	require.NoError(t, err)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pod",
+			Namespace:   "default",
+			Annotations: map[string]string{excludeContainersAnnotation: "worker, unknown"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "registry.example.com/app:1.0.0"},
+				{Name: "istio-proxy", Image: "registry.example.com/istio/proxyv2:1.20.0"},
+				{Name: "worker", Image: "registry.example.com/worker:1.0.0"},
+				{Name: "vendor", Image: "docker.io/vendor/tool:latest"},
+				{Name: "api", Image: "registry.example.com/api:1.0.0"},
+			},
+		},
+	}
+
+	whsvr := &Webhook{Logger: zap.NewNop().Sugar()}
+	patchBytes, err := whsvr.createPatch(whsvr.newPodMutation(context.Background(), pod, config))
+	require.NoError(t, err)
+
+	var patches []patchOperation
+	require.NoError(t, json.Unmarshal(patchBytes, &patches))
+	assert.Equal(t, []string{"/spec/containers/0/env", "/spec/containers/4/env"}, firstPatchPaths(patches))
+}
+
+func TestUpdateContainer_ConflictPolicy(t *testing.T) {
+	t.Parallel()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"}}
+	container := &corev1.Container{
+		Name:  "app",
+		Image: "app:1.0.0",
+		Env: []corev1.EnvVar{
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", Value: "stale-cluster"},
+			{Name: "EXISTING_VAR", Value: "value"},
+			{Name: "NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", Value: "app"},
+		},
+	}
+
+	configWithPolicy := func(policy string) *InjectionConfig {
+		config, err := ParseInjectionConfig([]byte("conflictPolicy: "+policy), nil)
+		require.NoError(t, err)
+		return config
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		t.Parallel()
+
+		whsvr := &Webhook{ClusterName: "real-cluster", Logger: zap.NewNop().Sugar()}
+		m := whsvr.newPodMutation(context.Background(), pod, configWithPolicy("replace"))
+		patches := whsvr.updateContainer(m, containersField, 0, container)
+
+		assert.Contains(t, patches, patchOperation{
+			Op:    "replace",
+			Path:  "/spec/containers/0/env/0",
+			Value: createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "real-cluster"),
+		})
+		for _, patch := range patches {
+			assert.NotEqual(t, "/spec/containers/0/env/2", patch.Path, "variables with the same value must not be replaced")
+		}
+		assert.Empty(t, m.conflicts)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		t.Parallel()
+
+		whsvr := &Webhook{ClusterName: "real-cluster", Logger: zap.NewNop().Sugar()}
+		m := whsvr.newPodMutation(context.Background(), pod, configWithPolicy("fail"))
+		patches := whsvr.updateContainer(m, containersField, 0, container)
+
+		for _, patch := range patches {
+			assert.Equal(t, "add", patch.Op)
+		}
+		assert.Equal(t, []string{
+			"app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+			"app/NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME",
+		}, m.conflicts)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := ParseInjectionConfig([]byte("conflictPolicy: overwrite"), nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestServeHTTP_ConflictPolicyFail(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte("conflictPolicy: fail"), nil)
+	require.NoError(t, err)
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "app",
+			Env:  []corev1.EnvVar{{Name: "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", Value: "copied"}},
+		}}},
+	}
+	raw, err := json.Marshal(&pod)
+	require.NoError(t, err)
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request:  &admissionv1.AdmissionRequest{UID: types.UID("1"), Object: runtime.RawExtension{Raw: raw}},
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(&Webhook{ClusterName: "foobar", Config: config})
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	assert.False(t, review.Response.Allowed)
+	assert.Nil(t, review.Response.Patch)
+	assert.Equal(t, int32(http.StatusConflict), review.Response.Result.Code)
+	assert.Contains(t, review.Response.Result.Message, "app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME")
+}
+
+func TestServeHTTP_ErrorPolicyDeny(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseInjectionConfig([]byte("errorPolicy: {invalidObject: deny}"), nil)
+	require.NoError(t, err)
+
+	body := bytes.Replace(makeTestData(t, "default"), []byte("\"object\""), []byte("\"foo\""), 1)
+	server := httptest.NewServer(&Webhook{ClusterName: "foobar", Config: config})
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	assert.False(t, review.Response.Allowed)
+	assert.Empty(t, review.Response.Warnings)
+	assert.Equal(t, int32(http.StatusBadRequest), review.Response.Result.Code)
+	assert.Equal(t, metav1.StatusReasonBadRequest, review.Response.Result.Reason)
+}
+
+func TestServeHTTP_MalformedRequest(t *testing.T) {
+	t.Parallel()
+
+	// The review can't be decoded, but its version and the UID of its request are known, so the error is reported in
+	// the status of the response.
+	body := []byte(`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1beta1","request":{"uid":"7","operation":1}}`)
+	server := httptest.NewServer(&Webhook{ClusterName: "foobar"})
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+	assert.Equal(t, "admission.k8s.io/v1beta1", review.APIVersion)
+	assert.Equal(t, types.UID("7"), review.Response.UID)
+	assert.True(t, review.Response.Allowed)
+	assert.Equal(t, int32(http.StatusBadRequest), review.Response.Result.Code)
+	assert.Contains(t, review.Response.Result.Message, "invalid admission review")
+}
+
+func TestErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		err    error
+		class  ErrorClass
+		code   int32
+		reason metav1.StatusReason
+	}{
+		{
+			name:   "invalid object",
+			err:    fmt.Errorf("%w: object not present in request body", errInvalidObject),
+			class:  ErrorClassInvalidObject,
+			code:   http.StatusBadRequest,
+			reason: metav1.StatusReasonBadRequest,
+		},
+		{
+			name:   "unsupported admission review",
+			err:    fmt.Errorf("%w: %q", errUnsupportedAdmissionReview, "admission.k8s.io/v2"),
+			class:  ErrorClassInvalidObject,
+			code:   http.StatusBadRequest,
+			reason: metav1.StatusReasonBadRequest,
+		},
+		{
+			name:   "internal",
+			err:    errors.New("boom"),
+			class:  ErrorClassInternal,
+			code:   http.StatusInternalServerError,
+			reason: metav1.StatusReasonInternalError,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			class, status := errorStatus(c.err)
+			assert.Equal(t, c.class, class)
+			assert.Equal(t, c.code, status.Code)
+			assert.Equal(t, c.reason, status.Reason)
+			// The pods that can't be mutated are admitted unless the error policy denies them explicitly, as they
+			// were when these errors made the webhook call fail under the Ignore failure policy.
+			assert.Equal(t, FailurePolicyAllow, DefaultInjectionConfig().failurePolicy(class))
+		})
+	}
+}
+
+func TestServeHTTP_AuditAnnotationsAndWarnings(t *testing.T) {
+	t.Parallel()
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-pod",
+			Namespace:       "default",
+			Annotations:     map[string]string{excludeContainersAnnotation: "proxy"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicationController", Name: "legacy"}},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Env: []corev1.EnvVar{{Name: "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", Value: "copied"}}},
+			{Name: "proxy"},
+		}},
+	}
+	raw, err := json.Marshal(&pod)
+	require.NoError(t, err)
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "AdmissionReview", APIVersion: "admission.k8s.io/v1"},
+		Request:  &admissionv1.AdmissionRequest{UID: types.UID("1"), Object: runtime.RawExtension{Raw: raw}},
+	})
+	require.NoError(t, err)
+
+	for _, warnings := range []bool{false, true} {
+		t.Run(fmt.Sprintf("warnings %t", warnings), func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(&Webhook{ClusterName: "foobar", AdmissionWarnings: warnings})
+			defer server.Close()
+
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var review admissionv1.AdmissionReview
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&review))
+			assert.True(t, review.Response.Allowed)
+			assert.Equal(t, map[string]string{
+				"injected-variables": "NEW_RELIC_METADATA_KUBERNETES_CONTAINER_IMAGE_NAME,NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME," +
+					"NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME,NEW_RELIC_METADATA_KUBERNETES_NODE_NAME,NEW_RELIC_METADATA_KUBERNETES_POD_NAME",
+				"skipped-containers":    "proxy (pod annotation (excluded container))",
+				"conflicting-variables": "app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+			}, review.Response.AuditAnnotations)
+
+			if !warnings {
+				assert.Empty(t, review.Response.Warnings)
+				return
+			}
+			assert.Equal(t, []string{
+				"New Relic metadata variables already defined were kept (1): app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+				"New Relic metadata of pods owned by a ReplicationController don't include the name of their workload",
+			}, review.Response.Warnings)
+		})
+	}
+}
+
+func TestAdmissionAuditWarnings_LongNames(t *testing.T) {
+	t.Parallel()
+
+	var defined []string
+	for _, container := range []string{"app", strings.Repeat("a", 63), "sidecar"} {
+		defined = append(defined, container+"/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", container+"/NEW_RELIC_METADATA_KUBERNETES_POD_NAME")
+	}
+	audit := &admissionAudit{defined: defined, unsupportedOwner: strings.Repeat("VeryLongCustomResourceKind", 5)}
+
+	// The warnings are kept under the length the API server truncates them at, telling how many variables are left
+	// out of the list.
+	warnings := audit.warnings()
+	require.Len(t, warnings, 2)
+	assert.Equal(t, "New Relic metadata variables already defined were kept (6): app/NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME, and 5 more", warnings[0])
+	assert.Len(t, warnings[1], maxWarningLength)
+	assert.True(t, strings.HasSuffix(warnings[1], "..."))
+
+	// Even the first variable is left out when it doesn't fit.
+	audit = &admissionAudit{defined: defined[2:], conflictPolicy: ConflictPolicyReplace}
+	assert.Equal(t, []string{"New Relic metadata variables already defined were replaced (4)"}, audit.warnings())
+}
+
+func TestMutate_DryRun(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"newrelic-metadata-injection": "enabled"}}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name: "web-5d8f7b6c9", Namespace: "apps", OwnerReferences: controllerRef(deploymentKind, "web"),
+		}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Name: "backup-29000000", Namespace: "apps", OwnerReferences: controllerRef(cronJobKind, "backup"),
+		}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "env", Namespace: "apps"},
+			Data:       map[string]string{"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME": "copied"},
+		},
+	)
+	config, err := ParseInjectionConfig([]byte(`
+conflictPolicy: replace
+namespaceSelector:
+  matchLabels:
+    newrelic-metadata-injection: enabled
+`), nil)
+	require.NoError(t, err)
+
+	pods := map[string]*corev1.Pod{
+		"deployment with envFrom": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "web-5d8f7b6c9-x2x4z", Namespace: "apps", OwnerReferences: controllerRef(replicaSetKind, "web-5d8f7b6c9"),
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:    "app",
+				EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "env"}}}},
+			}}},
+		},
+		"cronjob": {
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "backup-29000000-k8f2d", Namespace: "apps", OwnerReferences: controllerRef(jobKind, "backup-29000000"),
+			},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "backup"}}},
+		},
+	}
+
+	for name, pod := range pods {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			whsvr := &Webhook{
+				ClusterName: "foobar",
+				Config:      config,
+				Logger:      zap.NewNop().Sugar(),
+				Namespaces:  NewNamespaceResolver(client, time.Minute),
+				Owners:      NewOwnerResolver(client, time.Minute),
+				EnvFrom:     NewEnvFromResolver(client, time.Minute),
+			}
+			raw, err := json.Marshal(pod)
+			require.NoError(t, err)
+			mutate := func(dryRun bool) ([]byte, *admissionAudit) {
+				t.Helper()
+				patch, audit, err := whsvr.mutate(context.Background(), &admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+					Operation: admissionv1.Create,
+					Namespace: "apps",
+					Object:    runtime.RawExtension{Raw: raw},
+					DryRun:    &dryRun,
+				}})
+				require.NoError(t, err)
+				return patch, audit
+			}
+
+			dryRunPatch, dryRunAudit := mutate(true)
+			assert.Empty(t, whsvr.Namespaces.cache.entries, "dry runs must not fill the caches")
+			assert.Empty(t, whsvr.Owners.cache.entries, "dry runs must not fill the caches")
+			assert.Empty(t, whsvr.EnvFrom.cache.entries, "dry runs must not fill the caches")
+
+			patch, audit := mutate(false)
+			assert.NotEmpty(t, patch)
+			assert.JSONEq(t, string(patch), string(dryRunPatch))
+			assert.Equal(t, audit, dryRunAudit)
+			assert.NotEmpty(t, whsvr.Namespaces.cache.entries)
+
+			// The caches filled by the regular admission are still read by the dry runs.
+			cachedPatch, _ := mutate(true)
+			assert.JSONEq(t, string(patch), string(cachedPatch))
+		})
+	}
+}